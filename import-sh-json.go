@@ -1,21 +1,31 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"regexp/syntax"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	_ "github.com/go-sql-driver/mysql"
+	"golang.org/x/text/cases"
 	"golang.org/x/text/transform"
 	"golang.org/x/text/unicode/norm"
 	"gopkg.in/yaml.v2"
@@ -23,15 +33,144 @@ import (
 
 const cOrigin = "bitergia-import-sh-json"
 
+// cDomainSrc - enrollments.src value marking enrollments with organization inferred from email domain
+const cDomainSrc = "import-sh-json-domain"
+
+// cMergeSrc - org_aliases.src value for aliases added by merge-orgs
+const cMergeSrc = "import-sh-json-merge"
+
+// cMappingSrc - org_aliases.src value for aliases learned from ORGS_MAP_FILE mappings
+const cMappingSrc = "import-sh-json-mapping"
+
+// cApprovedSrc - org_aliases.src value for aliases of organizations added after ORGS_APPROVED review
+const cApprovedSrc = "import-sh-json-approved"
+
+// cFoundationSrc - enrollments.src value marking foundation level enrollments derived from sub-projects
+const cFoundationSrc = "import-sh-json-foundation"
+
 // gProjectSlug comes from PROJECT_SLUG env (if set)
 var gProjectSlug *string
 
+// gEnrollmentsFrom, gEnrollmentsTo - enrollments date window from ENROLLMENTS_FROM and ENROLLMENTS_TO env (if set)
+var (
+	gEnrollmentsFrom *time.Time
+	gEnrollmentsTo   *time.Time
+)
+
+// gDatedMappings - date effective organization mappings from ORGS_DATED_MAP_FILE (if set), sorted by date
+var gDatedMappings []datedMapping
+
+// gOrgParents - subsidiary organization key -> parent organization name from ORGS_HIERARCHY_FILE (if set)
+var gOrgParents map[string]string
+
+// gOrgsRollup - ORGS_ROLLUP env: enroll under "parent" (default), "subsidiary" or "both" organizations
+var gOrgsRollup string
+
+// domainOrg - domains_organizations entry
+type domainOrg struct {
+	orgID int
+	isTop bool
+}
+
+// gDomainOrgs - lower case domain -> organization from domains_organizations when ORGS_DOMAINS env is set
+var gDomainOrgs map[string]domainOrg
+
+// identityConflict - identity found in the database under a different uuid than in import files
+type identityConflict struct {
+	id       string
+	source   string
+	fromUUID string
+	toUUID   string
+	action   string
+}
+
+// gIdentityConflictPolicy - IDENTITY_CONFLICT env: "move" (default), "skip" or "merge"
+var gIdentityConflictPolicy string
+
+// gProfileMergePolicies - PROFILE_MERGE env: profile field -> "prefer-incoming", "prefer-existing", "prefer-non-null" or "newest-wins"
+// nil when PROFILE_MERGE is not set, profiles are then replaced as a whole
+var gProfileMergePolicies map[string]string
+
+// gDefaultBotRules - bot detection rules used when BOTS_DETECT is set without BOTS_RULES_FILE
+var gDefaultBotRules = []botRule{
+	{Field: "any", Re: `(?i)\[bot\]$`},
+	{Field: "username", Re: `(?i)([-_.]bot$|^bot[-_.])`},
+	{Field: "username", Re: `(?i)^(dependabot|renovate|greenkeeper|github-actions|jenkins|travis|codecov|mergify|k8s-ci-robot)`},
+	{Field: "email", Re: `(?i)^(no-?reply|do-?not-?reply|bot|ci|build|jenkins)@`},
+}
+
+// gBotRules - compiled bot detection rules, nil when bot detection is disabled
+var gBotRules []botRule
+
+// gBotsSkipEnroll - BOTS_SKIP_ENROLL env: do not add enrollments for bots
+var gBotsSkipEnroll bool
+
+// gBotDecisions - bot detection decisions, guarded by gBotDecisionsMtx
+var (
+	gBotDecisions    []botDecision
+	gBotDecisionsMtx sync.Mutex
+)
+
+// gPrivacyKey - PRIVACY_KEY env: key used to pseudonymize personal attributes, nil when privacy mode is disabled
+var gPrivacyKey []byte
+
+// gEmailCanonical - EMAIL_CANONICAL env: email canonicalization rules "lower", "plus" and "gmail", nil when disabled
+var gEmailCanonical map[string]bool
+
+// gCanonicalEmailIDs - canonical email -> ids of identities having it, loaded when "plus" or "gmail" rules are used
+var (
+	gCanonicalEmailIDs    map[string][]string
+	gCanonicalEmailIDsMtx sync.RWMutex
+)
+
+// gTransliterate - TRANSLITERATE env: store names, emails and usernames transliterated to ASCII instead of NFC normalized UTF-8
+var gTransliterate bool
+
+// gColumnLimits - "table.column" -> maximum length in characters, loaded from information_schema
+var gColumnLimits map[string]int
+
+// gTruncations - values truncated to fit database columns, guarded by gTruncationsMtx
+var (
+	gTruncations    []truncation
+	gTruncationsMtx sync.Mutex
+)
+
+// gPatch - PATCH env: import files are patches, only profile keys present in them are written, explicit nulls clear values
+var gPatch bool
+
+// gIdentityMatching - IDENTITY_MATCHING env: keys used to find existing identities, any of "id", "email", "username", "tuple"
+var gIdentityMatching []string
+
+// gMatchingBlacklist - lower case values from matching_blacklist, never used for identity matching
+var gMatchingBlacklist map[string]struct{}
+
+// gIdentityConflicts - detected identity conflicts, guarded by gIdentityConflictsMtx
+var (
+	gIdentityConflicts    []identityConflict
+	gIdentityConflictsMtx sync.Mutex
+)
+
+// gFoundationSlug - "foundation" part of "foundation/project" PROJECT_SLUG when SYNC_FOUNDATION env is set
+var gFoundationSlug *string
+
+// dbExecutor - *sql.DB or *sql.Tx
+type dbExecutor interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
 // shTime - used to parse non standart time format in Bitergia JSON
 type shTime struct {
 	time.Time
 	Set bool
 }
 
+// shTimestamp - last modification timestamp in Bitergia JSON
+type shTimestamp struct {
+	time.Time
+	Set bool
+}
+
 // shCountry - country data
 type shCountry struct {
 	Alpha3 string `json:"alpha3"`
@@ -49,6 +188,7 @@ type shProfile struct {
 	Name        *string    `json:"name"`
 	UUID        string     `json:"uuid"`
 	CountryCode *string
+	present     map[string]bool
 }
 
 // shIdentity - signgle identity data
@@ -70,6 +210,9 @@ type shEnrollment struct {
 	End          shTime `json:"end"`
 	OrgID        int
 	ProjectSlug  *string
+	Inferred     bool
+	Src          *string
+	Role         *string
 }
 
 // shUIdentity - single unique identity data
@@ -78,7 +221,7 @@ type shUIdentity struct {
 	Profile      shProfile      `json:"profile"`
 	Identities   []shIdentity   `json:"identities"`
 	Enrollments  []shEnrollment `json:"enrollments"`
-	LastModified time.Time
+	LastModified shTimestamp    `json:"last_modified"`
 }
 
 // shData - Bitergia's identities export data format
@@ -88,21 +231,41 @@ type shData struct {
 
 // importStats - statistics about added/updated/deleted objects
 type importStats struct {
-	uidentitiesAdded   int
-	uidentitiesFound   int
-	profilesAdded      int
-	profilesFound      int
-	profilesSame       int
-	profilesDeleted    int
-	identitiesAdded    int
-	identitiesFound    int
-	identitiesSame     int
-	identitiesDeleted  int
-	enrollmentsAdded   int
-	enrollmentsFound   int
-	enrollmentsSame    int
-	enrollmentsDeleted int
-	enrollmentsSkipped int
+	uidentitiesAdded     int
+	uidentitiesFound     int
+	profilesAdded        int
+	profilesFound        int
+	profilesSame         int
+	profilesDeleted      int
+	identitiesAdded      int
+	identitiesFound      int
+	identitiesSame       int
+	identitiesDeleted    int
+	enrollmentsAdded     int
+	enrollmentsFound     int
+	enrollmentsSame      int
+	enrollmentsDeleted   int
+	enrollmentsSkipped   int
+	foundationAdded      int
+	foundationDeleted    int
+	enrollmentsPruned    int
+	uidentitiesPruned    int
+	enrollmentsOutside   int
+	enrollmentsPreserved int
+	enrollmentsSplit     int
+	enrollmentsRolledUp  int
+	enrollmentsInferred  int
+	enrollmentsDuplicate int
+	identitiesConflicts  int
+	identitiesMoved      int
+	identitiesSkipped    int
+	uidentitiesMerged    int
+	profilesMerged       int
+	botsDetected         int
+	enrollmentsBots      int
+	valuesTruncated      int
+	profilesPatched      int
+	uidentitiesMissing   int
 }
 
 // allmappings - company names mapping from dev-analytics-affiliation
@@ -110,6 +273,111 @@ type allMappings struct {
 	Mappings [][2]string `yaml:"mappings"`
 }
 
+// orgMappingRule - single compiled ORGS_MAP_FILE mapping rule
+// rx is nil when the regexp cannot be compiled by Go, MariaDB is asked to match such rules then
+type orgMappingRule struct {
+	re string
+	to string
+	rx *regexp.Regexp
+}
+
+// orgMapping - memoized organization name mapping result
+type orgMapping struct {
+	cid   int
+	to    string
+	rule  int
+	found bool
+}
+
+// orgMapper - company names mappings compiled once and matched in-process
+// Matching semantics follow MariaDB "select ? regexp ?" with utf8mb4_unicode_520_ci collation (case insensitive)
+// Order is deterministic, first match wins: original name is checked against all rules in file order,
+// then lower case name is checked against all rules in file order. A rule matches only if its target organization exists
+// (exact name first, then by orgKey). Results are memoized per organization name.
+type orgMapper struct {
+	db    *sql.DB
+	rules []orgMappingRule
+	memo  map[string]orgMapping
+	mtx   sync.RWMutex
+}
+
+// orgUsage - how many uuids and enrollments use an organization name in import files
+type orgUsage struct {
+	uuids       map[string]struct{}
+	enrollments int
+}
+
+// orgCandidate - existing organization similar to a missing one
+type orgCandidate struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+// missingOrg - MISSING_ORGS_CSV report entry
+type missingOrg struct {
+	Name        string         `json:"name"`
+	UUIDs       int            `json:"uuids"`
+	Enrollments int            `json:"enrollments"`
+	SampleUUIDs []string       `json:"sample_uuids"`
+	Candidates  []orgCandidate `json:"candidates"`
+}
+
+// orgRegistry - organizations known to the import, safe for concurrent use
+// byID holds canonical (organizations table) names, byName and byKey map canonical names and aliases
+// (mapped or cosmetically different spellings) to organization ids
+type orgRegistry struct {
+	byID   map[int]string
+	byName map[string]int
+	byKey  map[string]int
+	mtx    sync.RWMutex
+}
+
+// datedMapping - organization mapping effective since a given date (acquisitions, renames)
+type datedMapping struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	Date string `yaml:"date"`
+	date time.Time
+}
+
+// allDatedMappings - ORGS_DATED_MAP_FILE contents
+type allDatedMappings struct {
+	Mappings []datedMapping `yaml:"mappings"`
+}
+
+// orgsHierarchy - ORGS_HIERARCHY_FILE contents, maps subsidiary organization names to their parent organization names
+type orgsHierarchy struct {
+	Parents map[string]string `yaml:"parents"`
+}
+
+// botRule - single bot detection rule, field is "name", "email", "username" or "any"
+type botRule struct {
+	Field string `yaml:"field"`
+	Re    string `yaml:"re"`
+	rx    *regexp.Regexp
+}
+
+// botRules - BOTS_RULES_FILE contents
+type botRules struct {
+	Rules []botRule `yaml:"rules"`
+}
+
+// botDecision - uidentity classified as a bot by bot detection rules
+type botDecision struct {
+	uuid  string
+	field string
+	value string
+	rule  string
+}
+
+// truncation - value truncated to fit its database column
+type truncation struct {
+	uuid     string
+	field    string
+	original string
+	value    string
+}
+
 const nils string = "(nil)"
 const emailStr string = ",Email:"
 
@@ -204,6 +472,29 @@ func fatalf(f string, a ...interface{}) {
 	fatalOnError(fmt.Errorf(f, a...))
 }
 
+// UnmarshalJSON - remembers which profile keys are present, so absent keys can be told from explicit nulls
+func (p *shProfile) UnmarshalJSON(b []byte) error {
+	type profile shProfile
+	var (
+		pr   profile
+		keys map[string]json.RawMessage
+	)
+	err := json.Unmarshal(b, &pr)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(b, &keys)
+	if err != nil {
+		return err
+	}
+	*p = shProfile(pr)
+	p.present = make(map[string]bool)
+	for key := range keys {
+		p.present[key] = true
+	}
+	return nil
+}
+
 func (sht *shTime) UnmarshalJSON(b []byte) (err error) {
 	s := strings.Trim(string(b), "\"")
 	if s == "null" {
@@ -217,6 +508,22 @@ func (sht *shTime) UnmarshalJSON(b []byte) (err error) {
 	return
 }
 
+// UnmarshalJSON - SortingHat last modification timestamps can have fractional seconds and a time zone
+func (sht *shTimestamp) UnmarshalJSON(b []byte) (err error) {
+	s := strings.Trim(string(b), "\"")
+	if s == "null" {
+		return
+	}
+	for _, dtFmt := range []string{"2006-01-02T15:04:05.999999", time.RFC3339Nano} {
+		sht.Time, err = time.Parse(dtFmt, s)
+		if err == nil {
+			sht.Set = true
+			return
+		}
+	}
+	return
+}
+
 func queryOut(query string, args ...interface{}) {
 	fmt.Printf("%s\n", query)
 	if len(args) > 0 {
@@ -237,7 +544,7 @@ func queryOut(query string, args ...interface{}) {
 	}
 }
 
-func query(db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+func query(db dbExecutor, query string, args ...interface{}) (*sql.Rows, error) {
 	rows, err := db.Query(query, args...)
 	if err != nil {
 		queryOut(query, args...)
@@ -245,7 +552,7 @@ func query(db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
 	return rows, err
 }
 
-func exec(db *sql.DB, skip, query string, args ...interface{}) (sql.Result, error) {
+func exec(db dbExecutor, skip, query string, args ...interface{}) (sql.Result, error) {
 	res, err := db.Exec(query, args...)
 	if err != nil {
 		if skip == "" || !strings.Contains(err.Error(), skip) {
@@ -255,155 +562,840 @@ func exec(db *sql.DB, skip, query string, args ...interface{}) (sql.Result, erro
 	return res, err
 }
 
-func addOrganization(db *sql.DB, company string) (int, bool) {
-	_, err := exec(db, "Error 1062", "insert into organizations(name) values(?)", stripUnicodeStr(company))
-	exists := false
-	if err != nil {
-		if strings.Contains(err.Error(), "Error 1062") {
-			rows, err2 := query(db, "select name from organizations where name = ?", company)
-			fatalOnError(err2)
-			var existingName string
-			for rows.Next() {
-				fatalOnError(rows.Scan(&existingName))
-			}
-			fatalOnError(rows.Err())
-			fatalOnError(rows.Close())
-			exists = true
-		} else {
-			fatalOnError(err)
+// mariaDBRegexp - converts MariaDB regexp syntax not supported by Go into Go equivalents
+func mariaDBRegexp(re string) string {
+	re = strings.Replace(re, "[[:<:]]", "\\b", -1)
+	re = strings.Replace(re, "[[:>:]]", "\\b", -1)
+	return "(?i)" + re
+}
+
+// newOrgMapper - compiles company names mappings, mappings file uses double backslashes which are unescaped here
+func newOrgMapper(db *sql.DB, mappings allMappings) *orgMapper {
+	mapper := &orgMapper{db: db, memo: make(map[string]orgMapping)}
+	for i, mapping := range mappings.Mappings {
+		re := strings.Replace(mapping[0], "\\\\", "\\", -1)
+		rx, err := regexp.Compile(mariaDBRegexp(re))
+		if err != nil {
+			fmt.Printf("mapping #%d '%s' cannot be compiled (%v), MariaDB will be used to match it\n", i+1, re, err)
+			rx = nil
 		}
+		mapper.rules = append(mapper.rules, orgMappingRule{re: re, to: mapping[1], rx: rx})
+	}
+	return mapper
+}
+
+// matches - checks if comp matches i-th rule
+func (m *orgMapper) matches(i int, comp string) bool {
+	rule := &m.rules[i]
+	if rule.rx != nil {
+		return rule.rx.MatchString(comp)
 	}
-	rows, err := query(db, "select id from organizations where name = ?", company)
+	rows, err := query(m.db, "select ? regexp ?", comp, rule.re)
 	fatalOnError(err)
-	var id int
-	fetched := false
+	var r int
 	for rows.Next() {
-		fatalOnError(rows.Scan(&id))
-		fetched = true
+		fatalOnError(rows.Scan(&r))
 	}
 	fatalOnError(rows.Err())
 	fatalOnError(rows.Close())
-	if !fetched {
-		fatalf("failed to add '%s' company", company)
+	return r > 0
+}
+
+// resolve - maps comp to an existing organization, lookup returns organization id for a mapping target name
+func (m *orgMapper) resolve(comp string, lookup func(string) (int, bool), dbg bool) (int, string, bool) {
+	m.mtx.RLock()
+	mapping, ok := m.memo[comp]
+	m.mtx.RUnlock()
+	if ok {
+		return mapping.cid, mapping.to, mapping.found
+	}
+	lComp := strings.ToLower(comp)
+	for pass, name := range []string{comp, lComp} {
+		if pass == 1 && name == comp {
+			break
+		}
+		if pass == 1 && dbg {
+			fmt.Printf("missing '%s' (trying lower case '%s')\n", comp, lComp)
+		}
+		for i, rule := range m.rules {
+			if !m.matches(i, name) {
+				continue
+			}
+			to := rule.to
+			if dbg {
+				fmt.Printf("'%s' matches #%d '%s'\n", name, i+1, rule.re)
+			}
+			cid, exists := lookup(to)
+			if !exists {
+				fmt.Printf("'%s' maps to '%s' which cannot be found\n", name, to)
+				continue
+			}
+			mapping = orgMapping{cid: cid, to: rule.to, rule: i + 1, found: true}
+			break
+		}
+		if mapping.found {
+			break
+		}
 	}
-	return id, exists
+	m.mtx.Lock()
+	m.memo[comp] = mapping
+	m.mtx.Unlock()
+	return mapping.cid, mapping.to, mapping.found
 }
 
-func addCountry(db *sql.DB, country *shCountry) (exists bool) {
-	_, err := exec(
-		db,
-		"Error 1062",
-		"insert into countries(code, alpha3, name) values(?,?,?)",
-		country.Code,
-		country.Alpha3,
-		stripUnicodeStr(country.Name),
+// orgSuffixes - legal entity suffixes ignored when comparing organization names
+var orgSuffixes = map[string]struct{}{
+	"inc": {}, "incorporated": {}, "ltd": {}, "limited": {}, "llc": {}, "llp": {}, "lp": {}, "gmbh": {}, "ag": {},
+	"corp": {}, "corporation": {}, "co": {}, "company": {}, "plc": {}, "sa": {}, "sas": {}, "sarl": {}, "srl": {},
+	"spa": {}, "bv": {}, "nv": {}, "ab": {}, "oy": {}, "as": {}, "kk": {}, "pty": {}, "pvt": {}, "private": {},
+}
+
+// normOrgName - normalizes organization name for similarity: lower case, no punctuation, no legal entity suffixes
+func normOrgName(name string) string {
+	name = strings.Map(
+		func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return r
+			}
+			if r == '&' || r == '+' {
+				return r
+			}
+			// "S.A." -> "sa", "O'Reilly" -> "oreilly"
+			if r == '.' || r == '\'' {
+				return -1
+			}
+			return ' '
+		},
+		name,
 	)
-	if err != nil {
-		if strings.Contains(err.Error(), "Error 1062") {
-			exists = true
-		} else {
-			fatalOnError(err)
+	words := strings.Fields(orgKey(name))
+	for len(words) > 1 {
+		_, ok := orgSuffixes[words[len(words)-1]]
+		if !ok {
+			break
 		}
+		words = words[:len(words)-1]
 	}
-	return
+	return strings.Join(words, " ")
 }
 
-func getThreadsNum() int {
-	// Use environment variable to have singlethreaded version
-	st := os.Getenv("ST") != ""
-	if st {
-		return 1
+// similarity - 1 - Levenshtein distance / longer string length
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	la, lb := len(ra), len(rb)
+	if la == 0 && lb == 0 {
+		return 1.0
 	}
-	nCPUs := 0
-	if os.Getenv("NCPUS") != "" {
-		n, err := strconv.Atoi(os.Getenv("NCPUS"))
-		fatalOnError(err)
-		if n > 0 {
-			nCPUs = n
-		}
+	if la < lb {
+		ra, rb, la, lb = rb, ra, lb, la
 	}
-	if nCPUs > 0 {
-		n := runtime.NumCPU()
-		if nCPUs > n {
-			nCPUs = n
+	prev := make([]int, lb+1)
+	curr := make([]int, lb+1)
+	for j := 0; j <= lb; j++ {
+		prev[j] = j
+	}
+	for i := 1; i <= la; i++ {
+		curr[0] = i
+		for j := 1; j <= lb; j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
 		}
-		runtime.GOMAXPROCS(nCPUs)
-		return nCPUs
+		prev, curr = curr, prev
 	}
-	nCPUs = runtime.NumCPU()
-	runtime.GOMAXPROCS(nCPUs)
-	return nCPUs
+	return 1.0 - float64(prev[lb])/float64(la)
 }
 
-func stripUnicode(pStr *string) *string {
-	if pStr == nil {
-		return nil
+// orgCandidates - returns top n existing organizations most similar to comp
+// normNames maps normalized names to existing organization names
+func orgCandidates(comp string, normNames map[string][]string, n int) (candidates []orgCandidate) {
+	norm := normOrgName(comp)
+	for normName, names := range normNames {
+		score := float64(int(similarity(norm, normName)*1000.0+0.5)) / 1000.0
+		for _, name := range names {
+			candidates = append(candidates, orgCandidate{Name: name, Score: score})
+		}
 	}
-	str := *pStr
-	isOk := func(r rune) bool {
-		return r < 32 || r >= 127
+	// Sorting all candidates by score then name makes ties independent of map iteration order
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
 	}
-	t := transform.Chain(norm.NFKD, transform.RemoveFunc(isOk))
-	str, _, _ = transform.String(t, str)
-	return &str
+	return
 }
 
-func stripUnicodeStr(str string) string {
-	isOk := func(r rune) bool {
-		return r < 32 || r >= 127
+// writeMissingOrgs - saves missing organizations report to CSV file and its JSON variant alongside
+func writeMissingOrgs(fileName string, missingOrgs map[string]struct{}, usage map[string]*orgUsage, orgNames []string, thrN int) {
+	nCandidates := 5
+	if os.Getenv("MISSING_ORGS_CANDIDATES") != "" {
+		var err error
+		nCandidates, err = strconv.Atoi(os.Getenv("MISSING_ORGS_CANDIDATES"))
+		fatalOnError(err)
 	}
-	t := transform.Chain(norm.NFKD, transform.RemoveFunc(isOk))
-	str, _, _ = transform.String(t, str)
-	return str
+	nSamples := 3
+	normNames := make(map[string][]string)
+	for _, name := range orgNames {
+		norm := normOrgName(name)
+		normNames[norm] = append(normNames[norm], name)
+	}
+	report := []missingOrg{}
+	for org := range missingOrgs {
+		entry := missingOrg{Name: org, SampleUUIDs: []string{}}
+		u, ok := usage[org]
+		if ok {
+			entry.UUIDs = len(u.uuids)
+			entry.Enrollments = u.enrollments
+			for uuid := range u.uuids {
+				entry.SampleUUIDs = append(entry.SampleUUIDs, uuid)
+			}
+			sort.Strings(entry.SampleUUIDs)
+			if len(entry.SampleUUIDs) > nSamples {
+				entry.SampleUUIDs = entry.SampleUUIDs[:nSamples]
+			}
+		}
+		report = append(report, entry)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Enrollments != report[j].Enrollments {
+			return report[i].Enrollments > report[j].Enrollments
+		}
+		return report[i].Name < report[j].Name
+	})
+	if nCandidates > 0 {
+		findCandidates := func(ch chan struct{}, i int) {
+			defer func() {
+				if ch != nil {
+					ch <- struct{}{}
+				}
+			}()
+			report[i].Candidates = orgCandidates(report[i].Name, normNames, nCandidates)
+		}
+		if thrN > 1 {
+			ch := make(chan struct{})
+			nThreads := 0
+			for i := range report {
+				go findCandidates(ch, i)
+				nThreads++
+				if nThreads == thrN {
+					<-ch
+					nThreads--
+				}
+			}
+			for nThreads > 0 {
+				<-ch
+				nThreads--
+			}
+		} else {
+			for i := range report {
+				findCandidates(nil, i)
+			}
+		}
+	}
+	csvFile, err := os.Create(fileName)
+	fatalOnError(err)
+	defer func() { _ = csvFile.Close() }()
+	writer := csv.NewWriter(csvFile)
+	fatalOnError(writer.Write([]string{"Organization Name", "UUIDs", "Enrollments", "Sample UUIDs", "Candidates"}))
+	for _, entry := range report {
+		candidates := []string{}
+		for _, candidate := range entry.Candidates {
+			candidates = append(candidates, fmt.Sprintf("%s (%.3f)", candidate.Name, candidate.Score))
+		}
+		fatalOnError(
+			writer.Write(
+				[]string{
+					entry.Name,
+					strconv.Itoa(entry.UUIDs),
+					strconv.Itoa(entry.Enrollments),
+					strings.Join(entry.SampleUUIDs, "; "),
+					strings.Join(candidates, "; "),
+				},
+			),
+		)
+	}
+	writer.Flush()
+	fatalOnError(writer.Error())
+	jsonFileName := strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".json"
+	if jsonFileName == fileName {
+		jsonFileName += ".json"
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	fatalOnError(err)
+	fatalOnError(ioutil.WriteFile(jsonFileName, data, 0644))
+	fmt.Printf("Missing organizations saved to %s and %s\n", fileName, jsonFileName)
 }
 
-func cleanUTF8(str string) string {
-	if strings.Contains(str, "\x00") {
-		return strings.Replace(str, "\x00", "", -1)
+// writeProposedOrgs - saves organizations that would be added to a review CSV file
+func writeProposedOrgs(fileName string, proposedOrgs map[string]struct{}, usage map[string]*orgUsage) {
+	names := []string{}
+	for org := range proposedOrgs {
+		names = append(names, org)
 	}
-	return str
+	sort.Strings(names)
+	csvFile, err := os.Create(fileName)
+	fatalOnError(err)
+	defer func() { _ = csvFile.Close() }()
+	writer := csv.NewWriter(csvFile)
+	fatalOnError(writer.Write([]string{"Organization Name", "UUIDs", "Enrollments"}))
+	for _, org := range names {
+		nUUIDs, nEnrollments := 0, 0
+		u, ok := usage[org]
+		if ok {
+			nUUIDs, nEnrollments = len(u.uuids), u.enrollments
+		}
+		fatalOnError(writer.Write([]string{org, strconv.Itoa(nUUIDs), strconv.Itoa(nEnrollments)}))
+	}
+	writer.Flush()
+	fatalOnError(writer.Error())
 }
 
-func truncToBytes(str string, size int) string {
-	str = cleanUTF8(str)
-	length := len(str)
-	if length < size {
-		return str
-	}
-	res := ""
-	i := 0
-	for _, r := range str {
-		if len(res+string(r)) > size {
-			break
+// readApprovedOrgs - reads approved organizations (first column of a review CSV file), returns set of their keys
+func readApprovedOrgs(fileName string) map[string]struct{} {
+	csvFile, err := os.Open(fileName)
+	fatalOnError(err)
+	defer func() { _ = csvFile.Close() }()
+	reader := csv.NewReader(csvFile)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	fatalOnError(err)
+	approved := make(map[string]struct{})
+	for i, record := range records {
+		if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
+			continue
 		}
-		res += string(r)
-		i++
+		if i == 0 && record[0] == "Organization Name" {
+			continue
+		}
+		approved[orgKey(record[0])] = struct{}{}
 	}
-	return res
+	return approved
 }
 
-func truncStringOrNil(strPtr *string, maxLen int) interface{} {
-	if strPtr == nil {
-		return nil
+func newOrgRegistry() *orgRegistry {
+	return &orgRegistry{
+		byID:   make(map[int]string),
+		byName: make(map[string]int),
+		byKey:  make(map[string]int),
 	}
-	return truncToBytes(*strPtr, maxLen)
 }
 
-func profilesDiffer(p1, p2 *shProfile) bool {
-	if p1.Name == nil && p2.Name != nil || p1.Name != nil && p2.Name == nil {
-		return true
+// add - adds organization with its canonical name, if id is already known its canonical name is kept
+func (r *orgRegistry) add(id int, name string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	_, ok := r.byID[id]
+	if !ok {
+		r.byID[id] = name
 	}
-	if p1.Name != nil && p2.Name != nil && stripUnicodeStr(*p1.Name) != stripUnicodeStr(*p2.Name) {
-		return true
+	r.byName[name] = id
+	key := orgKey(name)
+	_, ok = r.byKey[key]
+	if !ok {
+		r.byKey[key] = id
 	}
-	if p1.Email == nil && p2.Email != nil || p1.Email != nil && p2.Email == nil {
-		return true
+}
+
+// addAlias - adds alias of an existing organization, canonical names are never overwritten by aliases
+func (r *orgRegistry) addAlias(alias string, id int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	_, ok := r.byName[alias]
+	if !ok {
+		r.byName[alias] = id
 	}
-	if p1.Email != nil && p2.Email != nil && stripUnicodeStr(*p1.Email) != stripUnicodeStr(*p2.Email) {
-		return true
+	key := orgKey(alias)
+	_, ok = r.byKey[key]
+	if !ok {
+		r.byKey[key] = id
 	}
-	if p1.GenderAcc == nil && p2.GenderAcc != nil || p1.GenderAcc != nil && p2.GenderAcc == nil {
-		return true
+}
+
+// lookup - finds organization id by canonical name or alias, exact match first then by orgKey
+func (r *orgRegistry) lookup(comp string) (int, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	id, ok := r.byName[comp]
+	if !ok {
+		id, ok = r.byKey[orgKey(comp)]
+	}
+	return id, ok
+}
+
+// has - checks if name is a canonical name or an alias (exact match)
+func (r *orgRegistry) has(name string) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	_, ok := r.byName[name]
+	return ok
+}
+
+// name - returns canonical organization name
+func (r *orgRegistry) name(id int) (string, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	name, ok := r.byID[id]
+	return name, ok
+}
+
+// resolve - finds organization id and canonical name by canonical name or alias
+func (r *orgRegistry) resolve(comp string) (int, string, bool) {
+	id, ok := r.lookup(comp)
+	if !ok {
+		return 0, "", false
+	}
+	name, ok := r.name(id)
+	if !ok {
+		name = comp
+	}
+	return id, name, true
+}
+
+// size - number of organizations
+func (r *orgRegistry) size() int {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return len(r.byID)
+}
+
+// orgDBName - canonical organization name as inserted into and looked up in organizations table:
+// NFC normalized UTF-8 with whitespace collapsed, never transliterated so non-latin names stay distinct
+func orgDBName(name string) string {
+	return strings.Join(strings.Fields(nfcStr(name)), " ")
+}
+
+// orgKey - organization identity key used by in-memory lookups, derived from orgDBName, mirrors utf8mb4_unicode_520_ci collation:
+// Unicode compatibility forms, accents and case differences are ignored too
+func orgKey(name string) string {
+	isMark := func(r rune) bool {
+		return unicode.Is(unicode.Mn, r)
+	}
+	t := transform.Chain(norm.NFKD, transform.RemoveFunc(isMark), norm.NFC)
+	key, _, _ := transform.String(t, orgDBName(name))
+	return strings.Join(strings.Fields(cases.Fold().String(key)), " ")
+}
+
+// resolvedRule - returns 1-based index of the rule that resolved comp, 0 if comp wasn't resolved by any rule
+func (m *orgMapper) resolvedRule(comp string) int {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.memo[comp].rule
+}
+
+// literalRegexp - returns the only string matched by a regexp that is an anchored literal text, like "^Foo Inc$"
+func literalRegexp(re string) (string, bool) {
+	parsed, err := syntax.Parse(re, syntax.Perl)
+	if err != nil || parsed.Op != syntax.OpConcat || len(parsed.Sub) < 3 {
+		return "", false
+	}
+	subs := parsed.Sub
+	if subs[0].Op != syntax.OpBeginText && subs[0].Op != syntax.OpBeginLine {
+		return "", false
+	}
+	if subs[len(subs)-1].Op != syntax.OpEndText && subs[len(subs)-1].Op != syntax.OpEndLine {
+		return "", false
+	}
+	literal := ""
+	for _, sub := range subs[1 : len(subs)-1] {
+		if sub.Op != syntax.OpLiteral {
+			return "", false
+		}
+		literal += string(sub.Rune)
+	}
+	return literal, true
+}
+
+// lintOrgsMap - checks ORGS_MAP_FILE mappings: regexps that don't compile, targets missing in organizations table,
+// rules shadowed by earlier ones and optionally how names from a given file (one per line) resolve
+func lintOrgsMap(db *sql.DB, args []string) {
+	if len(args) == 0 {
+		fmt.Printf("Arguments required: lint-orgs-map mappings.yaml [names.txt]\n")
+		return
+	}
+	var mappings allMappings
+	data, err := ioutil.ReadFile(args[0])
+	fatalOnError(err)
+	fatalOnError(yaml.Unmarshal(data, &mappings))
+	registry := newOrgRegistry()
+	rows, err := query(db, "select id, name from organizations order by id")
+	fatalOnError(err)
+	for rows.Next() {
+		var (
+			orgID   int
+			orgName string
+		)
+		fatalOnError(rows.Scan(&orgID, &orgName))
+		registry.add(orgID, orgName)
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	nAliases := loadOrgAliases(db, registry)
+	mapper := newOrgMapper(db, mappings)
+	nErrors, nWarnings := 0, 0
+	invalid := make(map[int]struct{})
+	for i, rule := range mapper.rules {
+		if rule.rx != nil {
+			continue
+		}
+		// Go cannot compile it, check if MariaDB can
+		rows, err := db.Query("select '' regexp ?", rule.re)
+		if err != nil {
+			fmt.Printf("error: #%d '%s' is not a valid regexp: %v\n", i+1, rule.re, err)
+			invalid[i] = struct{}{}
+			nErrors++
+			continue
+		}
+		fatalOnError(rows.Close())
+	}
+	for i, rule := range mapper.rules {
+		_, ok := registry.lookup(rule.to)
+		if !ok {
+			fmt.Printf("error: #%d '%s' maps to '%s' which doesn't exist\n", i+1, rule.re, rule.to)
+			nErrors++
+			continue
+		}
+		if !registry.has(rule.to) {
+			cid, _ := registry.lookup(rule.to)
+			name, _ := registry.name(cid)
+			fmt.Printf("warning: #%d '%s' maps to '%s' which only differs cosmetically from '%s'\n", i+1, rule.re, rule.to, name)
+			nWarnings++
+		}
+	}
+	for j, rule := range mapper.rules {
+		_, ok := invalid[j]
+		if ok {
+			continue
+		}
+		literal, isLiteral := literalRegexp(rule.re)
+		for i := 0; i < j; i++ {
+			_, ok := invalid[i]
+			if ok {
+				continue
+			}
+			earlier := mapper.rules[i]
+			shadowed := earlier.re == rule.re
+			if !shadowed && isLiteral {
+				shadowed = mapper.matches(i, literal) || mapper.matches(i, strings.ToLower(literal))
+			}
+			if !shadowed {
+				continue
+			}
+			if orgKey(earlier.to) == orgKey(rule.to) {
+				fmt.Printf("warning: #%d '%s' is redundant, #%d '%s' maps to '%s' already\n", j+1, rule.re, i+1, earlier.re, earlier.to)
+				nWarnings++
+			} else {
+				fmt.Printf("error: #%d '%s' -> '%s' is shadowed by #%d '%s' -> '%s'\n", j+1, rule.re, rule.to, i+1, earlier.re, earlier.to)
+				nErrors++
+			}
+			break
+		}
+	}
+	if len(args) > 1 {
+		data, err := ioutil.ReadFile(args[1])
+		fatalOnError(err)
+		for _, name := range strings.Split(string(data), "\n") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			cid, org, ok := registry.resolve(name)
+			if ok {
+				fmt.Printf("'%s' -> '%s' (%d): existing organization or alias\n", name, org, cid)
+				continue
+			}
+			cid, _, found := mapper.resolve(name, registry.lookup, false)
+			if !found {
+				fmt.Printf("'%s': not resolved\n", name)
+				continue
+			}
+			i := mapper.resolvedRule(name)
+			org, _ = registry.name(cid)
+			fmt.Printf("'%s' -> '%s' (%d): by #%d '%s'\n", name, org, cid, i, mapper.rules[i-1].re)
+		}
+	}
+	fmt.Printf("%d rules, %d organizations, %d aliases: %d errors, %d warnings\n", len(mapper.rules), registry.size(), nAliases, nErrors, nWarnings)
+	if nErrors > 0 {
+		os.Exit(1)
+	}
+}
+
+func addOrganization(db *sql.DB, company string) (int, string, bool) {
+	name, _ := fitColumn("", "organizations.name", orgDBName(company))
+	if name == "" {
+		fatalf("organization '%s' has an empty name", company)
+	}
+	_, err := exec(db, "Error 1062", "insert into organizations(name) values(?)", name)
+	exists := false
+	if err != nil {
+		if strings.Contains(err.Error(), "Error 1062") {
+			exists = true
+		} else {
+			fatalOnError(err)
+		}
+	}
+	rows, err := query(db, "select id from organizations where name = ?", name)
+	fatalOnError(err)
+	var id int
+	fetched := false
+	for rows.Next() {
+		fatalOnError(rows.Scan(&id))
+		fetched = true
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	if !fetched {
+		fatalf("failed to add '%s' company", company)
+	}
+	return id, name, exists
+}
+
+func addCountry(db *sql.DB, country *shCountry) (exists bool) {
+	_, err := exec(
+		db,
+		"Error 1062",
+		"insert into countries(code, alpha3, name) values(?,?,?)",
+		country.Code,
+		country.Alpha3,
+		normalizeUnicodeStr(country.Name),
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "Error 1062") {
+			exists = true
+		} else {
+			fatalOnError(err)
+		}
+	}
+	return
+}
+
+func getThreadsNum() int {
+	// Use environment variable to have singlethreaded version
+	st := os.Getenv("ST") != ""
+	if st {
+		return 1
+	}
+	nCPUs := 0
+	if os.Getenv("NCPUS") != "" {
+		n, err := strconv.Atoi(os.Getenv("NCPUS"))
+		fatalOnError(err)
+		if n > 0 {
+			nCPUs = n
+		}
+	}
+	if nCPUs > 0 {
+		n := runtime.NumCPU()
+		if nCPUs > n {
+			nCPUs = n
+		}
+		runtime.GOMAXPROCS(nCPUs)
+		return nCPUs
+	}
+	nCPUs = runtime.NumCPU()
+	runtime.GOMAXPROCS(nCPUs)
+	return nCPUs
+}
+
+// normalizeUnicode - normalizeUnicodeStr for nullable strings
+func normalizeUnicode(pStr *string) *string {
+	if pStr == nil {
+		return nil
+	}
+	str := normalizeUnicodeStr(*pStr)
+	return &str
+}
+
+// normalizeUnicodeStr - returns NFC normalized UTF-8 without control characters
+// When TRANSLITERATE is set, string is decomposed and stripped to printable ASCII instead ("José" -> "Jose")
+func normalizeUnicodeStr(str string) string {
+	if gTransliterate {
+		isOk := func(r rune) bool {
+			return r < 32 || r >= 127
+		}
+		t := transform.Chain(norm.NFKD, transform.RemoveFunc(isOk))
+		str, _, _ = transform.String(t, str)
+		return str
+	}
+	return nfcStr(str)
+}
+
+// nfcStr - returns NFC normalized valid UTF-8 without control characters
+func nfcStr(str string) string {
+	t := transform.Chain(norm.NFC, transform.RemoveFunc(unicode.IsControl))
+	str, _, _ = transform.String(t, strings.ToValidUTF8(str, ""))
+	return str
+}
+
+func cleanUTF8(str string) string {
+	if strings.Contains(str, "\x00") {
+		return strings.Replace(str, "\x00", "", -1)
+	}
+	return str
+}
+
+func truncToBytes(str string, size int) string {
+	str = cleanUTF8(str)
+	length := len(str)
+	if length < size {
+		return str
+	}
+	res := ""
+	i := 0
+	for _, r := range str {
+		if len(res+string(r)) > size {
+			break
+		}
+		res += string(r)
+		i++
+	}
+	return res
+}
+
+// loadColumnLimits - loads character columns lengths of tables written by import from information_schema
+func loadColumnLimits(db *sql.DB) {
+	rows, err := query(
+		db,
+		"select table_name, column_name, character_maximum_length from information_schema.columns where table_schema = database() "+
+			"and table_name in ('uidentities', 'profiles', 'identities', 'organizations', 'org_aliases') and character_maximum_length is not null",
+	)
+	fatalOnError(err)
+	gColumnLimits = make(map[string]int)
+	for rows.Next() {
+		var (
+			table  string
+			column string
+			limit  int
+		)
+		fatalOnError(rows.Scan(&table, &column, &limit))
+		gColumnLimits[table+"."+column] = limit
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+}
+
+// fitColumn - truncates value to its column length (in characters, never splitting a rune), every truncation is reported
+// Returns truncated value and whether it was truncated
+func fitColumn(uuid, field, str string) (string, bool) {
+	limit, ok := gColumnLimits[field]
+	if !ok || utf8.RuneCountInString(str) <= limit {
+		return str, false
+	}
+	runes := []rune(str)
+	value := string(runes[:limit])
+	fmt.Printf("Truncated %s %s to %d characters: '%s' -> '%s'\n", uuid, field, limit, str, value)
+	gTruncationsMtx.Lock()
+	gTruncations = append(gTruncations, truncation{uuid: uuid, field: field, original: str, value: value})
+	gTruncationsMtx.Unlock()
+	return value, true
+}
+
+// fitUIdentity - normalizes and truncates uidentity's values to fit their database columns
+// Returns the number of truncated values
+func fitUIdentity(uidentity *shUIdentity) (n int) {
+	if gColumnLimits == nil {
+		return
+	}
+	uuid := uidentity.UUID
+	fit := func(field string, pStr *string) *string {
+		if pStr == nil {
+			return nil
+		}
+		str, truncated := fitColumn(uuid, field, normalizeUnicodeStr(*pStr))
+		if truncated {
+			n++
+		}
+		return &str
+	}
+	uidentity.Profile.Name = fit("profiles.name", uidentity.Profile.Name)
+	uidentity.Profile.Email = fit("profiles.email", uidentity.Profile.Email)
+	uidentity.Profile.Gender = fit("profiles.gender", uidentity.Profile.Gender)
+	if uidentity.Profile.Country != nil {
+		country := *uidentity.Profile.Country
+		country.Code = *fit("profiles.country_code", &country.Code)
+		uidentity.Profile.Country = &country
+	}
+	identities := []shIdentity{}
+	for _, identity := range uidentity.Identities {
+		identity.Source = *fit("identities.source", &identity.Source)
+		identity.Name = fit("identities.name", identity.Name)
+		identity.Email = fit("identities.email", identity.Email)
+		identity.Username = fit("identities.username", identity.Username)
+		identities = append(identities, identity)
+	}
+	uidentity.Identities = identities
+	return
+}
+
+// skipLongIdentityIDs - removes identities whose id (primary key) doesn't fit its column, truncating could merge different identities
+// Skipped identities are reported as truncations with an empty value, returns the number of skipped identities
+func skipLongIdentityIDs(uidentity *shUIdentity) (n int) {
+	limit, ok := gColumnLimits["identities.id"]
+	if !ok || gPrivacyKey != nil {
+		return
+	}
+	identities := []shIdentity{}
+	for _, identity := range uidentity.Identities {
+		if utf8.RuneCountInString(identity.ID) <= limit {
+			identities = append(identities, identity)
+			continue
+		}
+		fmt.Printf("Skipping %s identity '%s': id longer than %d characters\n", uidentity.UUID, identity.ID, limit)
+		gTruncationsMtx.Lock()
+		gTruncations = append(gTruncations, truncation{uuid: uidentity.UUID, field: "identities.id", original: identity.ID})
+		gTruncationsMtx.Unlock()
+		n++
+	}
+	uidentity.Identities = identities
+	return
+}
+
+// writeTruncations - saves truncated values to a CSV file
+func writeTruncations(fileName string) {
+	csvFile, err := os.Create(fileName)
+	fatalOnError(err)
+	defer func() { _ = csvFile.Close() }()
+	writer := csv.NewWriter(csvFile)
+	fatalOnError(writer.Write([]string{"UUID", "Field", "Original", "Truncated"}))
+	for _, t := range gTruncations {
+		fatalOnError(writer.Write([]string{t.uuid, t.field, t.original, t.value}))
+	}
+	writer.Flush()
+	fatalOnError(writer.Error())
+}
+
+func truncStringOrNil(strPtr *string, maxLen int) interface{} {
+	if strPtr == nil {
+		return nil
+	}
+	return truncToBytes(*strPtr, maxLen)
+}
+
+func profilesDiffer(p1, p2 *shProfile) bool {
+	if p1.Name == nil && p2.Name != nil || p1.Name != nil && p2.Name == nil {
+		return true
+	}
+	if p1.Name != nil && p2.Name != nil && normalizeUnicodeStr(*p1.Name) != normalizeUnicodeStr(*p2.Name) {
+		return true
+	}
+	if p1.Email == nil && p2.Email != nil || p1.Email != nil && p2.Email == nil {
+		return true
+	}
+	if p1.Email != nil && p2.Email != nil && canonicalEmail(normalizeUnicodeStr(*p1.Email)) != canonicalEmail(normalizeUnicodeStr(*p2.Email)) {
+		return true
+	}
+	if p1.GenderAcc == nil && p2.GenderAcc != nil || p1.GenderAcc != nil && p2.GenderAcc == nil {
+		return true
 	}
 	if p1.GenderAcc != nil && p2.GenderAcc != nil && *p1.GenderAcc != *p2.GenderAcc {
 		return true
@@ -417,68 +1409,1308 @@ func profilesDiffer(p1, p2 *shProfile) bool {
 	if p1.CountryCode == nil && p2.CountryCode != nil || p1.CountryCode != nil && p2.CountryCode == nil {
 		return true
 	}
-	if p1.CountryCode != nil && p2.CountryCode != nil && truncToBytes(*p1.CountryCode, 2) != truncToBytes(*p2.CountryCode, 2) {
-		return true
+	if p1.CountryCode != nil && p2.CountryCode != nil && truncToBytes(*p1.CountryCode, 2) != truncToBytes(*p2.CountryCode, 2) {
+		return true
+	}
+	return false
+}
+
+// profileValue - returns printable profile field value and whether it is null
+func profileValue(v interface{}) (string, bool) {
+	switch value := v.(type) {
+	case *string:
+		if value != nil {
+			return *value, false
+		}
+	case *int:
+		if value != nil {
+			return strconv.Itoa(*value), false
+		}
+	case *bool:
+		if value != nil {
+			return strconv.FormatBool(*value), false
+		}
+	}
+	return nils, true
+}
+
+// takeProfileField - decides whether incoming profile field value replaces the existing one using field's PROFILE_MERGE policy
+// Every decision about a differing value is logged
+func takeProfileField(uuid, field string, existing, incoming interface{}, incomingNewer bool) bool {
+	existingStr, existingNil := profileValue(existing)
+	incomingStr, incomingNil := profileValue(incoming)
+	if existingNil == incomingNil && (existingStr == incomingStr || (field == "email" && canonicalEmail(existingStr) == canonicalEmail(incomingStr))) {
+		return false
+	}
+	policy := gProfileMergePolicies[field]
+	take := false
+	switch policy {
+	case "prefer-incoming":
+		take = true
+	case "prefer-existing":
+		take = existingNil
+	case "prefer-non-null":
+		take = !incomingNil || existingNil
+	case "newest-wins":
+		take = incomingNewer
+	}
+	decision := "keeping existing"
+	if take {
+		decision = "taking incoming"
+	}
+	fmt.Printf("Profile %s %s: existing '%s', incoming '%s', %s: %s\n", uuid, field, existingStr, incomingStr, policy, decision)
+	return take
+}
+
+// profileFieldsDiffer - any of profile columns written by PROFILE_MERGE and PATCH differs
+func profileFieldsDiffer(p1, p2 *shProfile) bool {
+	for _, values := range [][2]interface{}{
+		{p1.Name, p2.Name},
+		{p1.Email, p2.Email},
+		{p1.Gender, p2.Gender},
+		{p1.GenderAcc, p2.GenderAcc},
+		{p1.IsBot, p2.IsBot},
+		{p1.CountryCode, p2.CountryCode},
+	} {
+		v1, nil1 := profileValue(values[0])
+		v2, nil2 := profileValue(values[1])
+		if v1 != v2 || nil1 != nil2 {
+			return true
+		}
+	}
+	return false
+}
+
+// newestWins - checks if any PROFILE_MERGE field uses newest-wins policy, import's last modification date is only stored then
+func newestWins() bool {
+	for _, policy := range gProfileMergePolicies {
+		if policy == "newest-wins" {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeProfile - merges incoming profile into the existing one field by field using PROFILE_MERGE policies
+func mergeProfile(existing, incoming *shProfile, incomingNewer bool) (merged shProfile) {
+	merged = *existing
+	uuid := existing.UUID
+	name, email, countryCode := normalizeUnicode(incoming.Name), normalizeUnicode(incoming.Email), incoming.CountryCode
+	if countryCode != nil {
+		code := truncToBytes(*countryCode, 2)
+		countryCode = &code
+	}
+	if takeProfileField(uuid, "name", existing.Name, name, incomingNewer) {
+		merged.Name = name
+	}
+	if takeProfileField(uuid, "email", existing.Email, email, incomingNewer) {
+		merged.Email = email
+	}
+	if takeProfileField(uuid, "gender", existing.Gender, incoming.Gender, incomingNewer) {
+		merged.Gender = incoming.Gender
+	}
+	if takeProfileField(uuid, "gender_acc", existing.GenderAcc, incoming.GenderAcc, incomingNewer) {
+		merged.GenderAcc = incoming.GenderAcc
+	}
+	if takeProfileField(uuid, "is_bot", existing.IsBot, incoming.IsBot, incomingNewer) {
+		merged.IsBot = incoming.IsBot
+	}
+	if takeProfileField(uuid, "country_code", existing.CountryCode, countryCode, incomingNewer) {
+		merged.CountryCode = countryCode
+	}
+	return
+}
+
+func identitiesDiffer(i1, i2 *shIdentity) bool {
+	if i1.UUID != i2.UUID {
+		return true
+	}
+	if i1.ID != i2.ID {
+		return true
+	}
+	if i1.Source != i2.Source {
+		return true
+	}
+	if i1.Name == nil && i2.Name != nil || i1.Name != nil && i2.Name == nil {
+		return true
+	}
+	if i1.Name != nil && i2.Name != nil && normalizeUnicodeStr(*i1.Name) != normalizeUnicodeStr(*i2.Name) {
+		return true
+	}
+	if i1.Email == nil && i2.Email != nil || i1.Email != nil && i2.Email == nil {
+		return true
+	}
+	if i1.Email != nil && i2.Email != nil && canonicalEmail(normalizeUnicodeStr(*i1.Email)) != canonicalEmail(normalizeUnicodeStr(*i2.Email)) {
+		return true
+	}
+	if i1.Username == nil && i2.Username != nil || i1.Username != nil && i2.Username == nil {
+		return true
+	}
+	if i1.Username != nil && i2.Username != nil && normalizeUnicodeStr(*i1.Username) != normalizeUnicodeStr(*i2.Username) {
+		return true
+	}
+	return false
+}
+
+// clipToWindow - clips enrollment period to the date window, returns false if enrollment doesn't overlap it
+func clipToWindow(e shEnrollment) (shEnrollment, bool) {
+	if gEnrollmentsFrom != nil {
+		if !e.End.After(*gEnrollmentsFrom) {
+			return e, false
+		}
+		if e.Start.Before(*gEnrollmentsFrom) {
+			e.Start = shTime{Time: *gEnrollmentsFrom, Set: true}
+		}
+	}
+	if gEnrollmentsTo != nil {
+		if !e.Start.Before(*gEnrollmentsTo) {
+			return e, false
+		}
+		if e.End.After(*gEnrollmentsTo) {
+			e.End = shTime{Time: *gEnrollmentsTo, Set: true}
+		}
+	}
+	return e, true
+}
+
+// outsideWindow - returns parts of enrollment period that are before and after the date window
+func outsideWindow(e shEnrollment) (parts []shEnrollment) {
+	if gEnrollmentsFrom != nil && e.Start.Before(*gEnrollmentsFrom) {
+		part := e
+		part.End = shTime{Time: *gEnrollmentsFrom, Set: true}
+		parts = append(parts, part)
+	}
+	if gEnrollmentsTo != nil && e.End.After(*gEnrollmentsTo) {
+		part := e
+		part.Start = shTime{Time: *gEnrollmentsTo, Set: true}
+		parts = append(parts, part)
+	}
+	return
+}
+
+func enrollmentsDiffer(e1, e2 []shEnrollment) bool {
+	if gEnrollmentsFrom != nil || gEnrollmentsTo != nil {
+		clip := func(enrollments []shEnrollment) (clipped []shEnrollment) {
+			for _, enrollment := range enrollments {
+				enrollment, ok := clipToWindow(enrollment)
+				if ok {
+					clipped = append(clipped, enrollment)
+				}
+			}
+			return
+		}
+		e1 = clip(e1)
+		e2 = clip(e2)
+	}
+	m1 := make(map[string]struct{})
+	m2 := make(map[string]struct{})
+	for _, enrollment := range e1 {
+		m1[enrollment.String()] = struct{}{}
+	}
+	for _, enrollment := range e2 {
+		m2[enrollment.String()] = struct{}{}
+	}
+	for k1 := range m1 {
+		_, ok := m2[k1]
+		if !ok {
+			return true
+		}
+	}
+	for k2 := range m2 {
+		_, ok := m1[k2]
+		if !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// loadDomainOrgs - loads domains_organizations table
+func loadDomainOrgs(db *sql.DB) {
+	rows, err := query(db, "select domain, coalesce(is_top_domain, 0), organization_id from domains_organizations")
+	fatalOnError(err)
+	gDomainOrgs = make(map[string]domainOrg)
+	for rows.Next() {
+		var (
+			domain string
+			do     domainOrg
+		)
+		fatalOnError(rows.Scan(&domain, &do.isTop, &do.orgID))
+		gDomainOrgs[strings.ToLower(strings.TrimSpace(domain))] = do
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+}
+
+// detectBot - classifies uidentity as a bot using bot detection rules, explicit is_bot from import is never overridden
+// Sets profile's is_bot when detected
+func detectBot(uidentity *shUIdentity) bool {
+	if uidentity.Profile.IsBot != nil {
+		return false
+	}
+	type candidate struct {
+		field string
+		value *string
+	}
+	candidates := []candidate{{"name", uidentity.Profile.Name}, {"email", uidentity.Profile.Email}}
+	for _, identity := range uidentity.Identities {
+		candidates = append(candidates, candidate{"name", identity.Name}, candidate{"email", identity.Email}, candidate{"username", identity.Username})
+	}
+	for _, rule := range gBotRules {
+		for _, c := range candidates {
+			if c.value == nil || (rule.Field != "any" && rule.Field != c.field) || !rule.rx.MatchString(*c.value) {
+				continue
+			}
+			isBot := true
+			uidentity.Profile.IsBot = &isBot
+			uuid, value := uidentity.UUID, *c.value
+			if gPrivacyKey != nil {
+				uuid, value = pseudonymUUID(uuid), *pseudonymizeStr(c.field, c.value)
+			}
+			fmt.Printf("Bot detected: %s %s '%s' matches '%s'\n", uuid, c.field, value, rule.Re)
+			gBotDecisionsMtx.Lock()
+			gBotDecisions = append(gBotDecisions, botDecision{uuid: uuid, field: c.field, value: value, rule: rule.Re})
+			gBotDecisionsMtx.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// writeBotDecisions - saves bot detection decisions to a CSV file
+func writeBotDecisions(fileName string) {
+	csvFile, err := os.Create(fileName)
+	fatalOnError(err)
+	defer func() { _ = csvFile.Close() }()
+	writer := csv.NewWriter(csvFile)
+	fatalOnError(writer.Write([]string{"UUID", "Field", "Value", "Rule"}))
+	for _, decision := range gBotDecisions {
+		fatalOnError(writer.Write([]string{decision.uuid, decision.field, decision.value, decision.rule}))
+	}
+	writer.Flush()
+	fatalOnError(writer.Error())
+}
+
+// pseudonym - returns deterministic keyed hash of a value, kind separates hashes of different attributes
+func pseudonym(kind, value string) string {
+	mac := hmac.New(sha256.New, gPrivacyKey)
+	_, _ = mac.Write([]byte(kind + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// pseudonymUUID - returns pseudonymized uuid
+func pseudonymUUID(uuid string) string {
+	return pseudonym("uuid", uuid)[:40]
+}
+
+// storedUUID - returns uuid as stored in the database (pseudonymized in privacy mode), reports use it too
+func storedUUID(uuid string) string {
+	if gPrivacyKey != nil {
+		return pseudonymUUID(uuid)
+	}
+	return uuid
+}
+
+// pseudonymizeStr - returns pseudonymized name, email or username, email domain is kept so organizations can still be inferred
+// Canonical email local part is hashed, so emails equal after canonicalization get the same pseudonym
+func pseudonymizeStr(kind string, pStr *string) *string {
+	if pStr == nil || *pStr == "" {
+		return pStr
+	}
+	var str string
+	switch kind {
+	case "name":
+		str = "User " + pseudonym(kind, *pStr)[:12]
+	case "email":
+		i := strings.LastIndex(*pStr, "@")
+		if i < 0 {
+			str = pseudonym(kind, canonicalEmail(*pStr))[:16]
+		} else {
+			canonical := canonicalEmail(*pStr)
+			str = pseudonym(kind, canonical[:strings.Index(canonical, "@")])[:16] + (*pStr)[i:]
+		}
+	default:
+		str = "user-" + pseudonym(kind, *pStr)[:12]
+	}
+	return &str
+}
+
+// pseudonymizeUIdentity - privacy mode: pseudonymizes names, emails, usernames, identity ids and uuid, drops gender
+// uuid is remapped consistently across uidentity, profile, identities and enrollments
+// Called just before writing, so bot detection and identity matching decisions use real values
+func pseudonymizeUIdentity(uidentity shUIdentity) shUIdentity {
+	uuid := pseudonymUUID(uidentity.UUID)
+	uidentity.UUID = uuid
+	uidentity.Profile.UUID = uuid
+	uidentity.Profile.Name = pseudonymizeStr("name", uidentity.Profile.Name)
+	uidentity.Profile.Email = pseudonymizeStr("email", uidentity.Profile.Email)
+	uidentity.Profile.Gender = nil
+	uidentity.Profile.GenderAcc = nil
+	identities := []shIdentity{}
+	for _, identity := range uidentity.Identities {
+		identity.UUID = uuid
+		identity.ID = pseudonym("id", identity.ID)[:40]
+		identity.Name = pseudonymizeStr("name", identity.Name)
+		identity.Email = pseudonymizeStr("email", identity.Email)
+		identity.Username = pseudonymizeStr("username", identity.Username)
+		identities = append(identities, identity)
+	}
+	uidentity.Identities = identities
+	enrollments := []shEnrollment{}
+	for _, enrollment := range uidentity.Enrollments {
+		enrollment.UUID = uuid
+		enrollments = append(enrollments, enrollment)
+	}
+	uidentity.Enrollments = enrollments
+	return uidentity
+}
+
+// canonicalEmail - returns email canonicalized using EMAIL_CANONICAL rules, used for matching and comparison only
+// "lower" lower cases, "plus" removes plus-addressing tag, "gmail" removes dots from Gmail addresses and unifies googlemail.com
+func canonicalEmail(email string) string {
+	if gEmailCanonical == nil {
+		return email
+	}
+	email = strings.TrimSpace(email)
+	if gEmailCanonical["lower"] {
+		email = strings.ToLower(email)
+	}
+	i := strings.Index(email, "@")
+	if i < 0 {
+		return email
+	}
+	local, domain := email[:i], email[i+1:]
+	if gEmailCanonical["plus"] {
+		j := strings.Index(local, "+")
+		if j >= 0 {
+			local = local[:j]
+		}
+	}
+	if gEmailCanonical["gmail"] {
+		lDomain := strings.ToLower(domain)
+		if lDomain == "gmail.com" || lDomain == "googlemail.com" {
+			local = strings.Replace(local, ".", "", -1)
+			domain = "gmail.com"
+		}
+	}
+	return local + "@" + domain
+}
+
+// loadCanonicalEmails - loads identity ids by canonical email, "plus" and "gmail" canonical emails cannot be matched by database indices
+func loadCanonicalEmails(db *sql.DB) {
+	rows, err := query(db, "select id, email from identities where email is not null")
+	fatalOnError(err)
+	gCanonicalEmailIDs = make(map[string][]string)
+	for rows.Next() {
+		var id, email string
+		fatalOnError(rows.Scan(&id, &email))
+		email = canonicalEmail(email)
+		gCanonicalEmailIDs[email] = append(gCanonicalEmailIDs[email], id)
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+}
+
+// addCanonicalEmail - registers newly inserted identity's email
+func addCanonicalEmail(id string, email *string) {
+	if gCanonicalEmailIDs == nil || email == nil {
+		return
+	}
+	key := canonicalEmail(*email)
+	gCanonicalEmailIDsMtx.Lock()
+	gCanonicalEmailIDs[key] = append(gCanonicalEmailIDs[key], id)
+	gCanonicalEmailIDsMtx.Unlock()
+}
+
+// emailCond - returns SQL condition and its args matching email column by canonical email
+// Exact match uses the email index, other spellings of the same canonical email are matched by their identity ids
+func emailCond(email *string) (string, []interface{}) {
+	if gCanonicalEmailIDs == nil || email == nil {
+		return "email <=> ?", []interface{}{email}
+	}
+	gCanonicalEmailIDsMtx.RLock()
+	ids := gCanonicalEmailIDs[canonicalEmail(*email)]
+	gCanonicalEmailIDsMtx.RUnlock()
+	if len(ids) == 0 {
+		return "email = ?", []interface{}{*email}
+	}
+	args := []interface{}{*email}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	return "(email = ? or id in (" + strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",") + "))", args
+}
+
+// loadMatchingBlacklist - loads matching_blacklist table
+func loadMatchingBlacklist(db *sql.DB) {
+	rows, err := query(db, "select excluded from matching_blacklist")
+	fatalOnError(err)
+	gMatchingBlacklist = make(map[string]struct{})
+	for rows.Next() {
+		var excluded string
+		fatalOnError(rows.Scan(&excluded))
+		gMatchingBlacklist[strings.ToLower(strings.TrimSpace(excluded))] = struct{}{}
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+}
+
+// matchable - value can be used for identity matching: it is set, not empty and not blacklisted
+func matchable(pStr *string) bool {
+	if pStr == nil {
+		return false
+	}
+	str := strings.ToLower(strings.TrimSpace(*pStr))
+	if str == "" {
+		return false
+	}
+	_, blacklisted := gMatchingBlacklist[str]
+	return !blacklisted
+}
+
+// blacklisted - value is listed in matching_blacklist
+func blacklisted(pStr *string) bool {
+	if pStr == nil {
+		return false
+	}
+	_, ok := gMatchingBlacklist[strings.ToLower(strings.TrimSpace(*pStr))]
+	return ok
+}
+
+// identityMatchCond - returns SQL condition and its args finding existing identities using IDENTITY_MATCHING keys
+// Identity id is the primary key so it is always matched, keys usable for matching are decided by raw (not pseudonymized) identity
+func identityMatchCond(raw, identity *shIdentity) (string, []interface{}) {
+	name, email, username := normalizeUnicode(identity.Name), normalizeUnicode(identity.Email), normalizeUnicode(identity.Username)
+	rawName, rawEmail, rawUsername := normalizeUnicode(raw.Name), normalizeUnicode(raw.Email), normalizeUnicode(raw.Username)
+	conds := []string{"id = ?"}
+	args := []interface{}{identity.ID}
+	for _, key := range gIdentityMatching {
+		switch key {
+		case "email":
+			if matchable(rawEmail) {
+				cond, condArgs := emailCond(email)
+				conds = append(conds, cond)
+				args = append(args, condArgs...)
+			}
+		case "username":
+			if matchable(rawUsername) {
+				conds = append(conds, "(username = ? and source = ?)")
+				args = append(args, username, identity.Source)
+			}
+		case "tuple":
+			// All NULL tuple would match every all NULL identity of the source
+			if !blacklisted(rawName) && !blacklisted(rawEmail) && !blacklisted(rawUsername) && (matchable(rawName) || matchable(rawEmail) || matchable(rawUsername)) {
+				cond, condArgs := emailCond(email)
+				conds = append(conds, "(name <=> ? and username <=> ? and source = ? and "+cond+")")
+				args = append(args, name, username, identity.Source)
+				args = append(args, condArgs...)
+			}
+		}
+	}
+	return strings.Join(conds, " or "), args
+}
+
+// sameIdentityKey - checks if existing identity was matched by id or by a key including source (username or name, email, username tuple)
+func sameIdentityKey(existing, identity *shIdentity) bool {
+	if existing.ID == identity.ID {
+		return true
+	}
+	if existing.Source != identity.Source {
+		return false
+	}
+	eq := func(p1, p2 *string, canonical func(string) string) bool {
+		if p1 == nil || p2 == nil {
+			return p1 == nil && p2 == nil
+		}
+		return canonical(normalizeUnicodeStr(*p1)) == canonical(normalizeUnicodeStr(*p2))
+	}
+	same := func(str string) string { return str }
+	if existing.Username != nil && eq(existing.Username, identity.Username, same) {
+		return true
+	}
+	return eq(existing.Name, identity.Name, same) && eq(existing.Email, identity.Email, canonicalEmail) && eq(existing.Username, identity.Username, same)
+}
+
+// insertIdentity - inserts identity, returns insert error so callers can handle collisions
+func insertIdentity(db dbExecutor, identity *shIdentity) error {
+	_, err := exec(
+		db,
+		"Error 1062",
+		"insert into identities(uuid, id, source, name, email, username, last_modified) values(?,?,?,?,?,?,now())",
+		identity.UUID,
+		identity.ID,
+		identity.Source,
+		normalizeUnicode(identity.Name),
+		normalizeUnicode(identity.Email),
+		normalizeUnicode(identity.Username),
+	)
+	return err
+}
+
+// domainOrgID - finds organization by email domains, subdomains match top domains only
+// Returns organization id and matched domain
+func domainOrgID(emails []string) (int, string, bool) {
+	for _, email := range emails {
+		i := strings.LastIndex(email, "@")
+		if i < 0 {
+			continue
+		}
+		domain := strings.ToLower(strings.TrimSpace(email[i+1:]))
+		do, ok := gDomainOrgs[domain]
+		if ok {
+			return do.orgID, domain, true
+		}
+		for {
+			j := strings.Index(domain, ".")
+			if j < 0 {
+				break
+			}
+			domain = domain[j+1:]
+			do, ok = gDomainOrgs[domain]
+			if ok && do.isTop {
+				return do.orgID, domain, true
+			}
+		}
+	}
+	return 0, "", false
+}
+
+// inferOrg - finds existing organization by uidentity's profile and identities email domains
+// Returns organization id, name and matched domain
+func inferOrg(uidentity *shUIdentity, orgs *orgRegistry) (int, string, string, bool) {
+	if gDomainOrgs == nil {
+		return 0, "", "", false
+	}
+	emails := []string{}
+	if uidentity.Profile.Email != nil {
+		emails = append(emails, *uidentity.Profile.Email)
+	}
+	for _, identity := range uidentity.Identities {
+		if identity.Email != nil {
+			emails = append(emails, *identity.Email)
+		}
+	}
+	orgID, domain, found := domainOrgID(emails)
+	if !found {
+		return 0, "", "", false
+	}
+	org, ok := orgs.name(orgID)
+	if !ok {
+		return 0, "", "", false
+	}
+	return orgID, org, domain, true
+}
+
+// datedMappingTargets - returns targets of date effective mappings that apply to any imported enrollment
+func datedMappingTargets(uidentitiesAry []map[string]shUIdentity, registry *orgRegistry) (targets []string) {
+	// latest enrollment end per organization, mapping targets inherit it so chained mappings are followed
+	latest := make(map[string]time.Time)
+	for _, uidentities := range uidentitiesAry {
+		for _, uidentity := range uidentities {
+			for _, e := range uidentity.Enrollments {
+				k := orgKey(e.Organization)
+				if e.End.After(latest[k]) {
+					latest[k] = e.End.Time
+				}
+			}
+		}
+	}
+	sameOrg := func(from, k string) bool {
+		if orgKey(from) == k {
+			return true
+		}
+		fromID, ok := registry.lookup(from)
+		if !ok {
+			return false
+		}
+		id, ok := registry.lookup(k)
+		return ok && id == fromID
+	}
+	used := make(map[string]struct{})
+	for changed := true; changed; {
+		changed = false
+		for _, mapping := range gDatedMappings {
+			toK := orgKey(mapping.To)
+			for k, end := range latest {
+				if !end.After(mapping.date) || !sameOrg(mapping.From, k) {
+					continue
+				}
+				if _, ok := used[mapping.To]; !ok {
+					used[mapping.To] = struct{}{}
+					targets = append(targets, mapping.To)
+				}
+				if end.After(latest[toK]) {
+					latest[toK] = end
+					changed = true
+				}
+			}
+		}
+	}
+	return
+}
+
+// applyDatedMappings - maps enrollments to organizations from date effective mappings
+// Enrollments crossing mapping's date are split into periods before and after that date
+// resolve returns organization id and name for a given organization name
+func applyDatedMappings(enrollments []shEnrollment, resolve func(string) (int, string, bool), dbg bool) (mapped []shEnrollment) {
+	var apply func(shEnrollment, int)
+	apply = func(e shEnrollment, depth int) {
+		if e.OrgID <= 0 || depth > len(gDatedMappings) {
+			mapped = append(mapped, e)
+			return
+		}
+		orgK := orgKey(e.Organization)
+		for _, mapping := range gDatedMappings {
+			if !e.End.After(mapping.date) {
+				continue
+			}
+			if orgKey(mapping.From) != orgK {
+				fromID, _, ok := resolve(mapping.From)
+				if !ok || fromID != e.OrgID {
+					continue
+				}
+			}
+			toID, toOrg, ok := resolve(mapping.To)
+			if !ok {
+				fmt.Printf("'%s' maps to '%s' since %s which cannot be found\n", e.Organization, mapping.To, mapping.Date)
+				continue
+			}
+			if dbg {
+				fmt.Printf("Enrollment %s: '%s' -> '%s' since %s\n", e.String(), e.Organization, toOrg, mapping.Date)
+			}
+			if e.Start.Before(mapping.date) {
+				before := e
+				before.End = shTime{Time: mapping.date, Set: true}
+				mapped = append(mapped, before)
+				e.Start = shTime{Time: mapping.date, Set: true}
+			}
+			e.OrgID = toID
+			e.Organization = toOrg
+			apply(e, depth+1)
+			return
+		}
+		mapped = append(mapped, e)
+	}
+	for _, enrollment := range enrollments {
+		apply(enrollment, 0)
+	}
+	return
+}
+
+// topParent - returns top-most parent organization name of a given organization (if any)
+func topParent(comp string) (parent string, ok bool) {
+	for i := 0; i <= len(gOrgParents); i++ {
+		p, found := gOrgParents[orgKey(comp)]
+		if !found {
+			return
+		}
+		parent, ok = p, true
+		comp = p
+	}
+	fatalf("organizations hierarchy contains a cycle at '%s'", comp)
+	return
+}
+
+// applyOrgsHierarchy - enrolls subsidiaries under their parent organizations depending on gOrgsRollup
+// resolve returns organization id and name for a given organization name
+func applyOrgsHierarchy(enrollments []shEnrollment, resolve func(string) (int, string, bool), dbg bool) (rolled []shEnrollment, nRolled int) {
+	seen := make(map[string]struct{})
+	add := func(e shEnrollment) {
+		key := fmt.Sprintf("%d:%s:%s", e.OrgID, e.Start.String(), e.End.String())
+		_, ok := seen[key]
+		if ok && e.OrgID > 0 {
+			return
+		}
+		seen[key] = struct{}{}
+		rolled = append(rolled, e)
+	}
+	for _, enrollment := range enrollments {
+		if enrollment.OrgID <= 0 {
+			add(enrollment)
+			continue
+		}
+		parent, ok := topParent(enrollment.Organization)
+		if !ok {
+			_, org, found := resolve(enrollment.Organization)
+			if found {
+				parent, ok = topParent(org)
+			}
+		}
+		if !ok {
+			add(enrollment)
+			continue
+		}
+		parentID, parentOrg, found := resolve(parent)
+		if !found {
+			fmt.Printf("'%s' parent organization '%s' cannot be found\n", enrollment.Organization, parent)
+			add(enrollment)
+			continue
+		}
+		if dbg {
+			fmt.Printf("Enrollment %s: '%s' rolled up to '%s' (%s)\n", enrollment.String(), enrollment.Organization, parentOrg, gOrgsRollup)
+		}
+		if gOrgsRollup == "both" {
+			add(enrollment)
+		}
+		enrollment.OrgID = parentID
+		enrollment.Organization = parentOrg
+		add(enrollment)
+		nRolled++
+	}
+	return
+}
+
+// mergePeriods - merges overlapping or adjacent periods of the same organization
+func mergePeriods(enrollments []shEnrollment) (merged []shEnrollment) {
+	strVal := func(pStr *string) string {
+		if pStr == nil {
+			return ""
+		}
+		return *pStr
+	}
+	sort.Slice(enrollments, func(i, j int) bool {
+		if enrollments[i].OrgID != enrollments[j].OrgID {
+			return enrollments[i].OrgID < enrollments[j].OrgID
+		}
+		if strVal(enrollments[i].Src) != strVal(enrollments[j].Src) {
+			return strVal(enrollments[i].Src) < strVal(enrollments[j].Src)
+		}
+		if strVal(enrollments[i].Role) != strVal(enrollments[j].Role) {
+			return strVal(enrollments[i].Role) < strVal(enrollments[j].Role)
+		}
+		return enrollments[i].Start.Before(enrollments[j].Start.Time)
+	})
+	for _, enrollment := range enrollments {
+		n := len(merged)
+		// Only periods with the same src and role are joined, so derived enrollments keep their origin
+		if n > 0 && merged[n-1].OrgID == enrollment.OrgID && strVal(merged[n-1].Src) == strVal(enrollment.Src) &&
+			strVal(merged[n-1].Role) == strVal(enrollment.Role) && !enrollment.Start.After(merged[n-1].End.Time) {
+			if enrollment.End.After(merged[n-1].End.Time) {
+				merged[n-1].End = enrollment.End
+			}
+			continue
+		}
+		merged = append(merged, enrollment)
+	}
+	return
+}
+
+// syncFoundationEnrollments - recomputes foundation level enrollments of a given uuid from all foundation's sub-projects
+// Only rows marked with cFoundationSrc are added/deleted, other foundation level enrollments are preserved
+func syncFoundationEnrollments(db *sql.DB, uuid string, dbg bool, sts *importStats) {
+	slug := *gFoundationSlug
+	likeSlug := strings.Replace(strings.Replace(strings.Replace(slug, "\\", "\\\\", -1), "%", "\\%", -1), "_", "\\_", -1) + "/%"
+	rows, err := query(
+		db,
+		"select organization_id, start, end from enrollments where uuid = ? and project_slug like ?",
+		uuid,
+		likeSlug,
+	)
+	fatalOnError(err)
+	projectsEnrollments := []shEnrollment{}
+	for rows.Next() {
+		var enrollment shEnrollment
+		fatalOnError(rows.Scan(&enrollment.OrgID, &enrollment.Start.Time, &enrollment.End.Time))
+		projectsEnrollments = append(projectsEnrollments, enrollment)
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	periodKey := func(e *shEnrollment) string {
+		return fmt.Sprintf("%d:%s:%s", e.OrgID, e.Start.Format(time.RFC3339), e.End.Format(time.RFC3339))
+	}
+	rows, err = query(
+		db,
+		"select id, organization_id, start, end, coalesce(src, '') from enrollments where uuid = ? and project_slug = ?",
+		uuid,
+		slug,
+	)
+	fatalOnError(err)
+	manual := make(map[string]struct{})
+	derived := make(map[string]int)
+	for rows.Next() {
+		var (
+			id         int
+			src        string
+			enrollment shEnrollment
+		)
+		fatalOnError(rows.Scan(&id, &enrollment.OrgID, &enrollment.Start.Time, &enrollment.End.Time, &src))
+		if src == cFoundationSrc {
+			derived[periodKey(&enrollment)] = id
+		} else {
+			manual[periodKey(&enrollment)] = struct{}{}
+		}
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	desired := make(map[string]struct{})
+	for _, enrollment := range mergePeriods(projectsEnrollments) {
+		key := periodKey(&enrollment)
+		_, ok := manual[key]
+		if ok {
+			continue
+		}
+		desired[key] = struct{}{}
+		_, ok = derived[key]
+		if ok {
+			continue
+		}
+		if dbg {
+			fmt.Printf("Foundation '%s' enrollment added: %s\n", slug, key)
+		}
+		_, err := exec(
+			db,
+			"",
+			"insert into enrollments(uuid, organization_id, start, end, project_slug, src) values(?,?,?,?,?,?)",
+			uuid,
+			enrollment.OrgID,
+			enrollment.Start.Time,
+			enrollment.End.Time,
+			slug,
+			cFoundationSrc,
+		)
+		fatalOnError(err)
+		sts.foundationAdded++
+	}
+	for key, id := range derived {
+		_, ok := desired[key]
+		if ok {
+			continue
+		}
+		if dbg {
+			fmt.Printf("Foundation '%s' enrollment deleted: %s\n", slug, key)
+		}
+		_, err := exec(db, "", "delete from enrollments where id = ?", id)
+		fatalOnError(err)
+		sts.foundationDeleted++
+	}
+}
+
+// uidentityMerge - unique identities merge report entry
+type uidentityMerge struct {
+	from              string
+	into              string
+	identitiesMoved   int
+	enrollmentsBefore int
+	enrollmentsAfter  int
+	profileFields     []string
+}
+
+// gUIdentityMerges - merges done, guarded by gIdentityConflictsMtx
+var gUIdentityMerges []uidentityMerge
+
+// gPendingMerges - [from, into] uuids to merge after all uidentities are processed, guarded by gIdentityConflictsMtx
+var gPendingMerges [][2]string
+
+// fetchProfile - returns profile of a given uuid (if any)
+func fetchProfile(db dbExecutor, uuid string) (profile shProfile, fetched bool) {
+	rows, err := query(
+		db,
+		"select uuid, name, email, gender, gender_acc, is_bot, country_code from profiles where uuid = ?",
+		uuid,
+	)
+	fatalOnError(err)
+	for rows.Next() {
+		fatalOnError(
+			rows.Scan(
+				&profile.UUID,
+				&profile.Name,
+				&profile.Email,
+				&profile.Gender,
+				&profile.GenderAcc,
+				&profile.IsBot,
+				&profile.CountryCode,
+			),
+		)
+		fetched = true
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	return
+}
+
+// mergeUIdentities - merges unique identity from into unique identity into, the same way SortingHat does, in one transaction:
+// identities are moved, enrollments of both are united and deduplicated per project slug (overlapping periods are joined),
+// profile fields missing in into are taken from from, from is archived and deleted
+func mergeUIdentities(db *sql.DB, from, into string) bool {
+	for _, uuid := range []string{from, into} {
+		rows, err := query(db, "select uuid from uidentities where uuid = ?", uuid)
+		fatalOnError(err)
+		fetched := false
+		for rows.Next() {
+			fetched = true
+		}
+		fatalOnError(rows.Err())
+		fatalOnError(rows.Close())
+		if !fetched {
+			fmt.Printf("Cannot merge %s into %s: %s no longer exists\n", from, into, uuid)
+			return false
+		}
+	}
+	report := uidentityMerge{from: from, into: into, profileFields: []string{}}
+	tx, err := db.Begin()
+	fatalOnError(err)
+	_, err = tx.Exec("set @origin = ?", cOrigin)
+	fatalOnError(err)
+	for _, archive := range []string{
+		"insert into uidentities_archive(uuid, last_modified) select uuid, last_modified from uidentities where uuid = ?",
+		"insert into identities_archive(id, name, email, username, source, uuid, last_modified) " +
+			"select id, name, email, username, source, uuid, last_modified from identities where uuid = ?",
+		"insert into profiles_archive(uuid, name, email, gender, gender_acc, is_bot, country_code) " +
+			"select uuid, name, email, gender, gender_acc, is_bot, country_code from profiles where uuid = ?",
+		"insert into enrollments_archive(id, start, end, uuid, organization_id, project_slug, role) " +
+			"select id, start, end, uuid, organization_id, project_slug, role from enrollments where uuid = ?",
+	} {
+		_, err = exec(tx, "", archive, from)
+		fatalOnError(err)
+	}
+	res, err := exec(tx, "", "update identities set uuid = ? where uuid = ?", into, from)
+	fatalOnError(err)
+	moved, err := res.RowsAffected()
+	fatalOnError(err)
+	report.identitiesMoved = int(moved)
+	// Enrollments: rows are identified by id, rows of into are preferred when periods are the same
+	type enrollmentRow struct {
+		id         int
+		uuid       string
+		enrollment shEnrollment
+	}
+	rows, err := query(
+		tx,
+		"select id, uuid, organization_id, start, end, coalesce(project_slug, ''), src, role from enrollments where uuid in (?, ?) order by uuid = ? desc, id",
+		into,
+		from,
+		into,
+	)
+	fatalOnError(err)
+	slugs := []string{}
+	bySlug := make(map[string][]enrollmentRow)
+	for rows.Next() {
+		var (
+			row  enrollmentRow
+			slug string
+		)
+		fatalOnError(
+			rows.Scan(
+				&row.id,
+				&row.uuid,
+				&row.enrollment.OrgID,
+				&row.enrollment.Start.Time,
+				&row.enrollment.End.Time,
+				&slug,
+				&row.enrollment.Src,
+				&row.enrollment.Role,
+			),
+		)
+		_, ok := bySlug[slug]
+		if !ok {
+			slugs = append(slugs, slug)
+		}
+		bySlug[slug] = append(bySlug[slug], row)
+		report.enrollmentsBefore++
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	periodKey := func(e *shEnrollment) string {
+		return fmt.Sprintf("%d:%s:%s", e.OrgID, e.Start.Format(time.RFC3339), e.End.Format(time.RFC3339))
+	}
+	for _, slug := range slugs {
+		var projectSlug *string
+		if slug != "" {
+			s := slug
+			projectSlug = &s
+		}
+		enrollments := []shEnrollment{}
+		byKey := make(map[string]enrollmentRow)
+		for _, row := range bySlug[slug] {
+			enrollments = append(enrollments, row.enrollment)
+			key := periodKey(&row.enrollment)
+			_, ok := byKey[key]
+			if !ok {
+				byKey[key] = row
+			}
+		}
+		keep := make(map[int]struct{})
+		added := make(map[string]struct{})
+		for _, enrollment := range mergePeriods(enrollments) {
+			// The same period can come with a different src or role, only one of them can be stored
+			key := periodKey(&enrollment)
+			_, dup := added[key]
+			if dup {
+				continue
+			}
+			added[key] = struct{}{}
+			report.enrollmentsAfter++
+			row, ok := byKey[key]
+			if ok {
+				keep[row.id] = struct{}{}
+				continue
+			}
+			role := "Contributor"
+			if enrollment.Role != nil {
+				role = *enrollment.Role
+			}
+			_, err := exec(
+				tx,
+				"",
+				"insert into enrollments(uuid, organization_id, start, end, project_slug, src, role) values(?,?,?,?,?,?,?)",
+				into,
+				enrollment.OrgID,
+				enrollment.Start.Time,
+				enrollment.End.Time,
+				projectSlug,
+				enrollment.Src,
+				role,
+			)
+			fatalOnError(err)
+		}
+		for _, row := range bySlug[slug] {
+			_, ok := keep[row.id]
+			if !ok {
+				_, err := exec(tx, "", "delete from enrollments where id = ?", row.id)
+				fatalOnError(err)
+			}
+		}
+		for _, row := range bySlug[slug] {
+			_, ok := keep[row.id]
+			if ok && row.uuid != into {
+				_, err := exec(tx, "", "update enrollments set uuid = ? where id = ?", into, row.id)
+				fatalOnError(err)
+			}
+		}
+	}
+	// Profile: fields missing in into are taken from from
+	fromProfile, fromFetched := fetchProfile(tx, from)
+	intoProfile, intoFetched := fetchProfile(tx, into)
+	if fromFetched {
+		if intoProfile.Name == nil && fromProfile.Name != nil {
+			intoProfile.Name = fromProfile.Name
+			report.profileFields = append(report.profileFields, "name")
+		}
+		if intoProfile.Email == nil && fromProfile.Email != nil {
+			intoProfile.Email = fromProfile.Email
+			report.profileFields = append(report.profileFields, "email")
+		}
+		if intoProfile.Gender == nil && fromProfile.Gender != nil {
+			intoProfile.Gender = fromProfile.Gender
+			intoProfile.GenderAcc = fromProfile.GenderAcc
+			report.profileFields = append(report.profileFields, "gender")
+		}
+		if intoProfile.IsBot == nil && fromProfile.IsBot != nil {
+			intoProfile.IsBot = fromProfile.IsBot
+			report.profileFields = append(report.profileFields, "is_bot")
+		}
+		if intoProfile.CountryCode == nil && fromProfile.CountryCode != nil {
+			intoProfile.CountryCode = fromProfile.CountryCode
+			report.profileFields = append(report.profileFields, "country_code")
+		}
 	}
-	return false
+	if len(report.profileFields) > 0 {
+		if intoFetched {
+			_, err = exec(
+				tx,
+				"",
+				"update profiles set name = ?, email = ?, gender = ?, gender_acc = ?, is_bot = ?, country_code = ? where uuid = ?",
+				intoProfile.Name,
+				intoProfile.Email,
+				intoProfile.Gender,
+				intoProfile.GenderAcc,
+				intoProfile.IsBot,
+				intoProfile.CountryCode,
+				into,
+			)
+		} else {
+			_, err = exec(
+				tx,
+				"",
+				"insert into profiles(uuid, name, email, gender, gender_acc, is_bot, country_code) values(?,?,?,?,?,?,?)",
+				into,
+				intoProfile.Name,
+				intoProfile.Email,
+				intoProfile.Gender,
+				intoProfile.GenderAcc,
+				intoProfile.IsBot,
+				intoProfile.CountryCode,
+			)
+		}
+		fatalOnError(err)
+	}
+	_, err = exec(tx, "", "delete from uidentities where uuid = ?", from)
+	fatalOnError(err)
+	fatalOnError(tx.Commit())
+	fmt.Printf(
+		"Merged %s into %s: moved %d identities, enrollments %d -> %d, profile fields taken: %s\n",
+		from,
+		into,
+		report.identitiesMoved,
+		report.enrollmentsBefore,
+		report.enrollmentsAfter,
+		strings.Join(report.profileFields, ","),
+	)
+	gIdentityConflictsMtx.Lock()
+	gUIdentityMerges = append(gUIdentityMerges, report)
+	gIdentityConflictsMtx.Unlock()
+	return true
 }
 
-func identitiesDiffer(i1, i2 *shIdentity) bool {
-	if i1.UUID != i2.UUID {
-		return true
+// writeUIdentityMerges - saves unique identities merge report to a CSV file
+func writeUIdentityMerges(fileName string) {
+	csvFile, err := os.Create(fileName)
+	fatalOnError(err)
+	defer func() { _ = csvFile.Close() }()
+	writer := csv.NewWriter(csvFile)
+	fatalOnError(writer.Write([]string{"Merged UUID", "Into UUID", "Identities Moved", "Enrollments Before", "Enrollments After", "Profile Fields Taken"}))
+	for _, merge := range gUIdentityMerges {
+		fatalOnError(
+			writer.Write(
+				[]string{
+					merge.from,
+					merge.into,
+					strconv.Itoa(merge.identitiesMoved),
+					strconv.Itoa(merge.enrollmentsBefore),
+					strconv.Itoa(merge.enrollmentsAfter),
+					strings.Join(merge.profileFields, ","),
+				},
+			),
+		)
 	}
-	if i1.ID != i2.ID {
-		return true
+	writer.Flush()
+	fatalOnError(writer.Error())
+}
+
+// writeIdentityConflicts - saves detected identity conflicts to a CSV file
+func writeIdentityConflicts(fileName string) {
+	csvFile, err := os.Create(fileName)
+	fatalOnError(err)
+	defer func() { _ = csvFile.Close() }()
+	writer := csv.NewWriter(csvFile)
+	fatalOnError(writer.Write([]string{"Identity ID", "Source", "DB UUID", "Import UUID", "Action"}))
+	for _, conflict := range gIdentityConflicts {
+		fatalOnError(writer.Write([]string{conflict.id, conflict.source, conflict.fromUUID, conflict.toUUID, conflict.action}))
 	}
-	if i1.Source != i2.Source {
-		return true
+	writer.Flush()
+	fatalOnError(writer.Error())
+}
+
+// pruneMaxPct - returns PRUNE_MAX_PCT threshold, 10% by default
+func pruneMaxPct() float64 {
+	maxPct := 10.0
+	if os.Getenv("PRUNE_MAX_PCT") != "" {
+		var err error
+		maxPct, err = strconv.ParseFloat(os.Getenv("PRUNE_MAX_PCT"), 64)
+		fatalOnError(err)
 	}
-	if i1.Name == nil && i2.Name != nil || i1.Name != nil && i2.Name == nil {
-		return true
+	return maxPct
+}
+
+// importedUUIDs - returns uuids present in import files (as written to the database)
+func importedUUIDs(uidentitiesAry []map[string]shUIdentity) map[string]struct{} {
+	uuids := make(map[string]struct{})
+	for _, uidentities := range uidentitiesAry {
+		for _, uidentity := range uidentities {
+			uuids[storedUUID(uidentity.UUID)] = struct{}{}
+		}
 	}
-	if i1.Name != nil && i2.Name != nil && stripUnicodeStr(*i1.Name) != stripUnicodeStr(*i2.Name) {
-		return true
+	return uuids
+}
+
+// pruneMissing - deletes PROJECT_SLUG enrollments (and optionally uidentities) of uuids not present in import files
+func pruneMissing(db *sql.DB, uuids map[string]struct{}, dbg bool, stats *importStats) {
+	pruneIdentities := os.Getenv("PRUNE_IDENTITIES") != ""
+	preview := os.Getenv("PRUNE_PREVIEW") != ""
+	force := os.Getenv("PRUNE_FORCE") != ""
+	maxPct := pruneMaxPct()
+	rows, err := query(db, "select uuid, count(*) from enrollments where project_slug = ? group by uuid", *gProjectSlug)
+	fatalOnError(err)
+	nExisting := 0
+	missing := make(map[string]int)
+	for rows.Next() {
+		var (
+			uuid string
+			cnt  int
+		)
+		fatalOnError(rows.Scan(&uuid, &cnt))
+		nExisting++
+		_, ok := uuids[uuid]
+		if !ok {
+			missing[uuid] = cnt
+		}
 	}
-	if i1.Email == nil && i2.Email != nil || i1.Email != nil && i2.Email == nil {
-		return true
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	missingUUIDs := []string{}
+	for uuid := range missing {
+		missingUUIDs = append(missingUUIDs, uuid)
 	}
-	if i1.Email != nil && i2.Email != nil && stripUnicodeStr(*i1.Email) != stripUnicodeStr(*i2.Email) {
-		return true
+	sort.Strings(missingUUIDs)
+	fmt.Printf("Prune: %d/%d uuids with '%s' enrollments are not present in import files\n", len(missingUUIDs), nExisting, *gProjectSlug)
+	for _, uuid := range missingUUIDs {
+		fmt.Printf("Prune: %s (%d enrollments)\n", uuid, missing[uuid])
 	}
-	if i1.Username == nil && i2.Username != nil || i1.Username != nil && i2.Username == nil {
-		return true
+	pruneCSV := os.Getenv("PRUNE_CSV")
+	if pruneCSV != "" {
+		csvFile, err := os.Create(pruneCSV)
+		fatalOnError(err)
+		defer func() { _ = csvFile.Close() }()
+		writer := csv.NewWriter(csvFile)
+		fatalOnError(writer.Write([]string{"UUID", "Enrollments"}))
+		for _, uuid := range missingUUIDs {
+			fatalOnError(writer.Write([]string{uuid, strconv.Itoa(missing[uuid])}))
+		}
+		writer.Flush()
+		fatalOnError(writer.Error())
 	}
-	if i1.Username != nil && i2.Username != nil && stripUnicodeStr(*i1.Username) != stripUnicodeStr(*i2.Username) {
-		return true
+	if len(missingUUIDs) == 0 {
+		return
 	}
-	return false
-}
-
-func enrollmentsDiffer(e1, e2 []shEnrollment) bool {
-	m1 := make(map[string]struct{})
-	m2 := make(map[string]struct{})
-	for _, enrollment := range e1 {
-		m1[enrollment.String()] = struct{}{}
+	pct := 100.0 * float64(len(missingUUIDs)) / float64(nExisting)
+	if preview {
+		if pct > maxPct && !force {
+			fmt.Printf("Prune: would affect %.2f%% uuids, which is more than the %.2f%% threshold, it would be aborted without PRUNE_FORCE=1\n", pct, maxPct)
+		}
+		fmt.Printf("Prune: returning due to preview mode\n")
+		return
 	}
-	for _, enrollment := range e2 {
-		m2[enrollment.String()] = struct{}{}
+	if pct > maxPct && !force {
+		fatalf("prune would affect %.2f%% uuids of '%s', which is more than the %.2f%% threshold, use PRUNE_FORCE=1 to override", pct, *gProjectSlug, maxPct)
 	}
-	for k1 := range m1 {
-		_, ok := m2[k1]
-		if !ok {
-			return true
+	var sts importStats
+	for _, uuid := range missingUUIDs {
+		res, err := exec(db, "", "delete from enrollments where uuid = ? and project_slug = ?", uuid, *gProjectSlug)
+		fatalOnError(err)
+		affected, err := res.RowsAffected()
+		fatalOnError(err)
+		sts.enrollmentsPruned += int(affected)
+		if gFoundationSlug != nil {
+			syncFoundationEnrollments(db, uuid, dbg, &sts)
 		}
-	}
-	for k2 := range m2 {
-		_, ok := m1[k2]
-		if !ok {
-			return true
+		if !pruneIdentities {
+			continue
+		}
+		rows, err := query(db, "select count(*) from enrollments where uuid = ?", uuid)
+		fatalOnError(err)
+		cnt := 0
+		for rows.Next() {
+			fatalOnError(rows.Scan(&cnt))
+		}
+		fatalOnError(rows.Err())
+		fatalOnError(rows.Close())
+		if cnt > 0 {
+			if dbg {
+				fmt.Printf("Prune: keeping %s which still has %d other enrollments\n", uuid, cnt)
+			}
+			continue
 		}
+		_, err = exec(db, "", "delete from uidentities where uuid = ?", uuid)
+		fatalOnError(err)
+		sts.uidentitiesPruned++
 	}
-	return false
+	stats.enrollmentsPruned += sts.enrollmentsPruned
+	stats.uidentitiesPruned += sts.uidentitiesPruned
+	stats.foundationAdded += sts.foundationAdded
+	stats.foundationDeleted += sts.foundationDeleted
 }
 
-func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity shUIdentity, comp2id map[string]int, id2comp map[int]string, flags []bool, stats *importStats) {
+func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity shUIdentity, orgs *orgRegistry, flags []bool, stats *importStats) {
 	defer func() {
 		if ch != nil {
 			ch <- struct{}{}
@@ -490,23 +2722,42 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 	replace := flags[1]
 	compare := flags[2]
 	orgsRO := flags[3]
-	rows, err := query(db, "select uuid from uidentities where uuid = ?", uidentity.UUID)
+	botDetected := gBotRules != nil && detectBot(&uidentity)
+	sts.identitiesSkipped += skipLongIdentityIDs(&uidentity)
+	// Identity matching decisions (matching_blacklist) use real values
+	rawIdentities := uidentity.Identities
+	if gPrivacyKey != nil {
+		uidentity = pseudonymizeUIdentity(uidentity)
+	}
+	sts.valuesTruncated += fitUIdentity(&uidentity)
+	if botDetected {
+		sts.botsDetected++
+	}
+	isBot := uidentity.Profile.IsBot != nil && *uidentity.Profile.IsBot
+	rows, err := query(db, "select uuid, last_modified from uidentities where uuid = ?", uidentity.UUID)
 	fatalOnError(err)
 	uuid := uidentity.UUID
+	var lastModified *time.Time
 	fetched := false
 	for rows.Next() {
-		fatalOnError(rows.Scan(&uuid))
+		fatalOnError(rows.Scan(&uuid, &lastModified))
 		fetched = true
 		break
 	}
 	fatalOnError(rows.Err())
 	fatalOnError(rows.Close())
 	if !fetched {
+		// Import's last modification date is kept for PROFILE_MERGE newest-wins policy
+		var importModified *time.Time
+		if uidentity.LastModified.Set && newestWins() {
+			importModified = &uidentity.LastModified.Time
+		}
 		_, err := exec(
 			db,
 			"",
-			"insert into uidentities(uuid, last_modified) values(?,now())",
+			"insert into uidentities(uuid, last_modified) values(?,coalesce(?,now()))",
 			uidentity.UUID,
+			importModified,
 		)
 		fatalOnError(err)
 		sts.uidentitiesAdded++
@@ -553,12 +2804,42 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 			fmt.Printf("Profiles differ: %+v != %+v\n", uidentity.Profile, existingProfile)
 		}
 	}
-	if fetched && !same && replace {
+	merged := false
+	if fetched && !same && replace && gProfileMergePolicies != nil {
+		if uidentity.Profile.Country != nil {
+			uidentity.Profile.CountryCode = &uidentity.Profile.Country.Code
+		}
+		// Import's last modification date is stored in uidentities, incoming profile is newer when either date is missing
+		incomingNewer := !uidentity.LastModified.Set || lastModified == nil || uidentity.LastModified.After(*lastModified)
+		profile := mergeProfile(&existingProfile, &uidentity.Profile, incomingNewer)
+		if uidentity.LastModified.Set && incomingNewer && newestWins() {
+			_, err := exec(db, "", "update uidentities set last_modified = ? where uuid = ?", uidentity.LastModified.Time, uidentity.UUID)
+			fatalOnError(err)
+		}
+		if profileFieldsDiffer(&profile, &existingProfile) {
+			_, err := exec(
+				db,
+				"",
+				"update profiles set name = ?, email = ?, gender = ?, gender_acc = ?, is_bot = ?, country_code = ? where uuid = ?",
+				profile.Name,
+				profile.Email,
+				profile.Gender,
+				profile.GenderAcc,
+				profile.IsBot,
+				profile.CountryCode,
+				uidentity.UUID,
+			)
+			fatalOnError(err)
+			sts.profilesMerged++
+		}
+		merged = true
+	}
+	if fetched && !same && replace && !merged {
 		_, err := exec(db, "", "delete from profiles where uuid = ?", uidentity.UUID)
 		fatalOnError(err)
 		sts.profilesDeleted++
 	}
-	if !same && (!fetched || (fetched && replace)) {
+	if !same && !merged && (!fetched || (fetched && replace)) {
 		if uidentity.Profile.Country != nil {
 			uidentity.Profile.CountryCode = &uidentity.Profile.Country.Code
 		}
@@ -567,8 +2848,8 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 			"",
 			"insert into profiles(uuid, name, email, gender, gender_acc, is_bot, country_code) values(?,?,?,?,?,?,?)",
 			uidentity.UUID,
-			stripUnicode(uidentity.Profile.Name),
-			stripUnicode(uidentity.Profile.Email),
+			normalizeUnicode(uidentity.Profile.Name),
+			normalizeUnicode(uidentity.Profile.Email),
 			uidentity.Profile.Gender,
 			uidentity.Profile.GenderAcc,
 			uidentity.Profile.IsBot,
@@ -577,19 +2858,22 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 		fatalOnError(err)
 		sts.profilesAdded++
 	}
-	for _, identity := range uidentity.Identities {
+	if botDetected {
+		// Existing profile that was not replaced, explicit is_bot is kept
+		_, err := exec(db, "", "update profiles set is_bot = 1 where uuid = ? and is_bot is null", uidentity.UUID)
+		fatalOnError(err)
+	}
+	for i, identity := range uidentity.Identities {
 		var existingIdentity shIdentity
+		fetched = false
+		matchCond, matchArgs := identityMatchCond(&rawIdentities[i], &identity)
+		// Identity with the same id is preferred over other matches
 		rows, err = query(
 			db,
-			"select uuid, id, email, name, source, username from identities where id = ? or (name = ? and email = ? and username = ? and source = ?)",
-			identity.ID,
-			stripUnicode(identity.Name),
-			stripUnicode(identity.Email),
-			stripUnicode(identity.Username),
-			identity.Source,
+			"select uuid, id, email, name, source, username from identities where "+matchCond+" order by id = ? desc limit 1",
+			append(matchArgs, identity.ID)...,
 		)
 		fatalOnError(err)
-		fetched = false
 		for rows.Next() {
 			fatalOnError(
 				rows.Scan(
@@ -609,6 +2893,36 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 		if fetched {
 			sts.identitiesFound++
 		}
+		if fetched && existingIdentity.UUID != identity.UUID {
+			conflict := identityConflict{
+				id:       identity.ID,
+				source:   identity.Source,
+				fromUUID: existingIdentity.UUID,
+				toUUID:   identity.UUID,
+				action:   gIdentityConflictPolicy,
+			}
+			sts.identitiesConflicts++
+			switch gIdentityConflictPolicy {
+			case "skip":
+				sts.identitiesSkipped++
+			case "merge":
+				// Merged uuid can be processed by other workers now, merges are done after all uidentities are processed
+				gIdentityConflictsMtx.Lock()
+				gPendingMerges = append(gPendingMerges, [2]string{existingIdentity.UUID, identity.UUID})
+				gIdentityConflictsMtx.Unlock()
+			default:
+				if !replace {
+					conflict.action = "none"
+				}
+			}
+			fmt.Printf("Identity %s (%s) belongs to %s, import has it under %s: %s\n", conflict.id, conflict.source, conflict.fromUUID, conflict.toUUID, conflict.action)
+			gIdentityConflictsMtx.Lock()
+			gIdentityConflicts = append(gIdentityConflicts, conflict)
+			gIdentityConflictsMtx.Unlock()
+			if gIdentityConflictPolicy == "skip" {
+				continue
+			}
+		}
 		same = false
 		if fetched && compare {
 			same = !identitiesDiffer(&identity, &existingIdentity)
@@ -618,52 +2932,68 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 				fmt.Printf("Identities differ: %+v != %+v\n", identity, existingIdentity)
 			}
 		}
-		if fetched && !same && replace {
-			_, err := exec(
-				db,
-				"",
-				"delete from identities where id = ? or (name = ? and email = ? and username = ? and source = ?)",
-				identity.ID,
-				stripUnicode(identity.Name),
-				stripUnicode(identity.Email),
-				stripUnicode(identity.Username),
-				identity.Source,
-			)
+		// Only identity matched by id or by a key including source is replaced, other matches (like shared email) are added alongside
+		replaceable := fetched && sameIdentityKey(&existingIdentity, &identity)
+		if replaceable && !same && replace {
+			// Delete and insert are rolled back when insert collides with other identity having the same name, email, username and source
+			tx, err := db.Begin()
+			fatalOnError(err)
+			_, err = tx.Exec("set @origin = ?", cOrigin)
+			fatalOnError(err)
+			_, err = exec(tx, "", "delete from identities where id in (?, ?)", existingIdentity.ID, identity.ID)
+			fatalOnError(err)
+			err = insertIdentity(tx, &identity)
+			if err != nil && strings.Contains(err.Error(), "Error 1062") {
+				fatalOnError(tx.Rollback())
+				fmt.Printf("Identity %s (%s) of %s collides with other identity having the same name, email, username and source, existing identity %s kept\n", identity.ID, identity.Source, identity.UUID, existingIdentity.ID)
+				sts.identitiesSkipped++
+				continue
+			}
 			fatalOnError(err)
+			fatalOnError(tx.Commit())
 			sts.identitiesDeleted++
+			if existingIdentity.UUID != identity.UUID {
+				sts.identitiesMoved++
+			}
+			addCanonicalEmail(identity.ID, normalizeUnicode(identity.Email))
+			sts.identitiesAdded++
+			continue
 		}
-		if !same && (!fetched || (fetched && replace)) {
-			_, err := exec(
-				db,
-				"",
-				"insert into identities(uuid, id, source, name, email, username, last_modified) values(?,?,?,?,?,?,now())",
-				identity.UUID,
-				identity.ID,
-				identity.Source,
-				stripUnicode(identity.Name),
-				stripUnicode(identity.Email),
-				stripUnicode(identity.Username),
-			)
+		if !same && !replaceable {
+			err := insertIdentity(db, &identity)
+			if err != nil && strings.Contains(err.Error(), "Error 1062") {
+				// Other identity with the same name, email, username and source was not matched, it is never deleted
+				fmt.Printf("Identity %s (%s) of %s collides with other identity having the same name, email, username and source, skipping\n", identity.ID, identity.Source, identity.UUID)
+				sts.identitiesSkipped++
+				continue
+			}
 			fatalOnError(err)
+			addCanonicalEmail(identity.ID, normalizeUnicode(identity.Email))
 			sts.identitiesAdded++
 		}
 	}
 	queryStr := ""
-	if gProjectSlug == nil {
-		if compare {
-			queryStr = "select uuid, organization_id, start, end, project_slug from enrollments where uuid = ? and project_slug is null"
-		} else {
-			queryStr = "select uuid from enrollments where uuid = ? and project_slug is null"
-		}
-		rows, err = query(db, queryStr, uidentity.UUID)
+	condStr := "uuid = ? and project_slug is null"
+	condArgs := []interface{}{uidentity.UUID}
+	if gProjectSlug != nil {
+		condStr = "uuid = ? and project_slug = ?"
+		condArgs = append(condArgs, *gProjectSlug)
+	}
+	if gEnrollmentsFrom != nil {
+		condStr += " and end > ?"
+		condArgs = append(condArgs, *gEnrollmentsFrom)
+	}
+	if gEnrollmentsTo != nil {
+		condStr += " and start < ?"
+		condArgs = append(condArgs, *gEnrollmentsTo)
+	}
+	window := gEnrollmentsFrom != nil || gEnrollmentsTo != nil
+	if compare || window {
+		queryStr = "select uuid, organization_id, start, end, project_slug, src, role from enrollments where " + condStr
 	} else {
-		if compare {
-			queryStr = "select uuid, organization_id, start, end, project_slug from enrollments where uuid = ? and project_slug = ?"
-		} else {
-			queryStr = "select uuid from enrollments where uuid = ? and project_slug = ?"
-		}
-		rows, err = query(db, queryStr, uidentity.UUID, *gProjectSlug)
+		queryStr = "select uuid from enrollments where " + condStr
 	}
+	rows, err = query(db, queryStr, condArgs...)
 	var (
 		existingEnrollments []shEnrollment
 		existingEnrollment  shEnrollment
@@ -671,7 +3001,7 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 	fatalOnError(err)
 	fetched = false
 	for rows.Next() {
-		if compare {
+		if compare || window {
 			fatalOnError(
 				rows.Scan(
 					&existingEnrollment.UUID,
@@ -679,25 +3009,23 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 					&existingEnrollment.Start.Time,
 					&existingEnrollment.End.Time,
 					&existingEnrollment.ProjectSlug,
+					&existingEnrollment.Src,
+					&existingEnrollment.Role,
 				),
 			)
-			if mtx != nil {
-				mtx.RLock()
-			}
-			organization, ok := id2comp[existingEnrollment.OrgID]
-			if mtx != nil {
-				mtx.RUnlock()
-			}
-			if !ok {
-				fatalf("organization id %d not found", existingEnrollment.OrgID)
+			if compare {
+				organization, ok := orgs.name(existingEnrollment.OrgID)
+				if !ok {
+					fatalf("organization id %d not found", existingEnrollment.OrgID)
+				}
+				existingEnrollment.Organization = organization
 			}
-			existingEnrollment.Organization = organization
 			existingEnrollments = append(existingEnrollments, existingEnrollment)
 		} else {
 			fatalOnError(rows.Scan(&uuid))
 		}
 		fetched = true
-		if !compare {
+		if !compare && !window {
 			break
 		}
 	}
@@ -705,15 +3033,18 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 	fatalOnError(rows.Close())
 	getCompIds := func() {
 		for i, enrollment := range uidentity.Enrollments {
-			if mtx != nil {
-				mtx.RLock()
-			}
-			orgID, ok := comp2id[enrollment.Organization]
-			if mtx != nil {
-				mtx.RUnlock()
-			}
+			orgID, ok := orgs.lookup(enrollment.Organization)
 			if !ok {
 				if orgsRO {
+					orgID, org, domain, found := inferOrg(&uidentity, orgs)
+					if found {
+						fmt.Printf("Enrollments: unknown organization: %s inferred as '%s' from '%s' domain for %s\n", enrollment.Organization, org, domain, uidentity.UUID)
+						uidentity.Enrollments[i].OrgID = orgID
+						uidentity.Enrollments[i].Organization = org
+						uidentity.Enrollments[i].Inferred = true
+						sts.enrollmentsInferred++
+						continue
+					}
 					fmt.Printf("Enrollments: unknown oranization: %s in: %+v\n", enrollment.Organization, uidentity.Enrollments)
 					continue
 				} else {
@@ -721,13 +3052,7 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 				}
 			}
 			uidentity.Enrollments[i].OrgID = orgID
-			if mtx != nil {
-				mtx.RLock()
-			}
-			org, ok := id2comp[orgID]
-			if mtx != nil {
-				mtx.RUnlock()
-			}
+			org, ok := orgs.name(orgID)
 			if !ok {
 				continue
 			}
@@ -738,10 +3063,21 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 				uidentity.Enrollments[i].Organization = org
 			}
 		}
+		if len(gDatedMappings) > 0 {
+			n := len(uidentity.Enrollments)
+			uidentity.Enrollments = applyDatedMappings(uidentity.Enrollments, orgs.resolve, dbg)
+			sts.enrollmentsSplit += len(uidentity.Enrollments) - n
+		}
+		if len(gOrgParents) > 0 && gOrgsRollup != "subsidiary" {
+			var nRolled int
+			uidentity.Enrollments, nRolled = applyOrgsHierarchy(uidentity.Enrollments, orgs.resolve, dbg)
+			sts.enrollmentsRolledUp += nRolled
+		}
 	}
 	if fetched {
 		sts.enrollmentsFound++
 	}
+	domainSrc := cDomainSrc
 	compIDCalculated := false
 	same = false
 	if fetched && compare {
@@ -755,56 +3091,247 @@ func processUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity
 		}
 	}
 	if fetched && !same && replace {
-		if gProjectSlug == nil {
-			_, err := exec(db, "", "delete from enrollments where uuid = ? and project_slug is null", uidentity.UUID)
-			fatalOnError(err)
-		} else {
-			_, err := exec(db, "", "delete from enrollments where uuid = ? and project_slug = ?", uidentity.UUID, *gProjectSlug)
-			fatalOnError(err)
-		}
+		_, err := exec(db, "", "delete from enrollments where "+condStr, condArgs...)
+		fatalOnError(err)
 		sts.enrollmentsDeleted++
+		// Put back parts of deleted enrollments that are outside of the date window
+		for _, existing := range existingEnrollments {
+			for _, remainder := range outsideWindow(existing) {
+				_, err := exec(
+					db,
+					"Error 1062",
+					"insert into enrollments(uuid, organization_id, start, end, project_slug, src, role) values(?,?,?,?,?,?,?)",
+					uidentity.UUID,
+					remainder.OrgID,
+					remainder.Start.Time,
+					remainder.End.Time,
+					gProjectSlug,
+					remainder.Src,
+					remainder.Role,
+				)
+				if err != nil {
+					if !strings.Contains(err.Error(), "Error 1062") {
+						fatalOnError(err)
+					}
+					continue
+				}
+				sts.enrollmentsPreserved++
+			}
+		}
 	}
 	if !same && (!fetched || (fetched && replace)) {
 		if !compIDCalculated {
 			getCompIds()
 		}
+		// Different organizations can resolve (be mapped or inferred) to the same one, each period is inserted once
+		// Enrollment that was not inferred is preferred
+		enrollments := []shEnrollment{}
+		seen := make(map[string]int)
 		for _, enrollment := range uidentity.Enrollments {
+			if enrollment.OrgID <= 0 {
+				enrollments = append(enrollments, enrollment)
+				continue
+			}
+			key := fmt.Sprintf("%d:%s:%s", enrollment.OrgID, enrollment.Start.String(), enrollment.End.String())
+			i, ok := seen[key]
+			if ok {
+				if enrollments[i].Inferred && !enrollment.Inferred {
+					enrollments[i] = enrollment
+				}
+				sts.enrollmentsDuplicate++
+				continue
+			}
+			seen[key] = len(enrollments)
+			enrollments = append(enrollments, enrollment)
+		}
+		for _, enrollment := range enrollments {
 			if orgsRO && enrollment.OrgID <= 0 {
 				sts.enrollmentsSkipped++
 				continue
 			}
+			if isBot && gBotsSkipEnroll {
+				sts.enrollmentsBots++
+				continue
+			}
+			if window {
+				var ok bool
+				enrollment, ok = clipToWindow(enrollment)
+				if !ok {
+					sts.enrollmentsOutside++
+					continue
+				}
+			}
+			var src *string
+			if enrollment.Inferred {
+				src = &domainSrc
+			}
 			_, err := exec(
 				db,
-				"",
-				"insert into enrollments(uuid, organization_id, start, end, project_slug) values(?,?,?,?,?)",
+				"Error 1062",
+				"insert into enrollments(uuid, organization_id, start, end, project_slug, src) values(?,?,?,?,?,?)",
 				enrollment.UUID,
 				enrollment.OrgID,
 				enrollment.Start.Time,
 				enrollment.End.Time,
 				gProjectSlug,
+				src,
+			)
+			if err != nil && strings.Contains(err.Error(), "Error 1062") {
+				// Clipped to the window period can be the same as other enrollment's one
+				sts.enrollmentsDuplicate++
+				continue
+			}
+			fatalOnError(err)
+			sts.enrollmentsAdded++
+		}
+	}
+	if gFoundationSlug != nil {
+		syncFoundationEnrollments(db, uidentity.UUID, dbg, &sts)
+	}
+	if mtx != nil {
+		mtx.Lock()
+	}
+	stats.uidentitiesAdded += sts.uidentitiesAdded
+	stats.uidentitiesFound += sts.uidentitiesFound
+	stats.profilesAdded += sts.profilesAdded
+	stats.profilesFound += sts.profilesFound
+	stats.profilesDeleted += sts.profilesDeleted
+	stats.profilesSame += sts.profilesSame
+	stats.identitiesAdded += sts.identitiesAdded
+	stats.identitiesFound += sts.identitiesFound
+	stats.identitiesSame += sts.identitiesSame
+	stats.identitiesDeleted += sts.identitiesDeleted
+	stats.enrollmentsAdded += sts.enrollmentsAdded
+	stats.enrollmentsFound += sts.enrollmentsFound
+	stats.enrollmentsSame += sts.enrollmentsSame
+	stats.enrollmentsDeleted += sts.enrollmentsDeleted
+	stats.enrollmentsSkipped += sts.enrollmentsSkipped
+	stats.enrollmentsDuplicate += sts.enrollmentsDuplicate
+	stats.foundationAdded += sts.foundationAdded
+	stats.foundationDeleted += sts.foundationDeleted
+	stats.enrollmentsOutside += sts.enrollmentsOutside
+	stats.enrollmentsPreserved += sts.enrollmentsPreserved
+	stats.enrollmentsSplit += sts.enrollmentsSplit
+	stats.enrollmentsRolledUp += sts.enrollmentsRolledUp
+	stats.enrollmentsInferred += sts.enrollmentsInferred
+	stats.identitiesConflicts += sts.identitiesConflicts
+	stats.identitiesMoved += sts.identitiesMoved
+	stats.identitiesSkipped += sts.identitiesSkipped
+	stats.profilesMerged += sts.profilesMerged
+	stats.botsDetected += sts.botsDetected
+	stats.enrollmentsBots += sts.enrollmentsBots
+	stats.valuesTruncated += sts.valuesTruncated
+	stats.profilesPatched += sts.profilesPatched
+	stats.uidentitiesMissing += sts.uidentitiesMissing
+	if mtx != nil {
+		mtx.Unlock()
+	}
+}
+
+// patchUIdentity - PATCH mode: updates profile fields present in import file (explicit nulls clear them), other fields are kept
+// Unique identities missing in the database are skipped, identities and enrollments are not touched
+func patchUIdentity(ch chan struct{}, mtx *sync.RWMutex, db *sql.DB, uidentity shUIdentity, dbg bool, stats *importStats) {
+	defer func() {
+		if ch != nil {
+			ch <- struct{}{}
+		}
+	}()
+	_, _ = db.Exec("set @origin = ?", cOrigin)
+	var sts importStats
+	sts.identitiesSkipped += skipLongIdentityIDs(&uidentity)
+	if gPrivacyKey != nil {
+		uidentity = pseudonymizeUIdentity(uidentity)
+	}
+	sts.valuesTruncated += fitUIdentity(&uidentity)
+	rows, err := query(db, "select uuid from uidentities where uuid = ?", uidentity.UUID)
+	fatalOnError(err)
+	fetched := false
+	for rows.Next() {
+		fetched = true
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	if fetched {
+		sts.uidentitiesFound++
+		incoming := uidentity.Profile
+		existing, profileFetched := fetchProfile(db, uidentity.UUID)
+		if profileFetched {
+			sts.profilesFound++
+		}
+		profile := existing
+		profile.UUID = uidentity.UUID
+		present := incoming.present
+		if present["name"] {
+			profile.Name = normalizeUnicode(incoming.Name)
+		}
+		if present["email"] {
+			profile.Email = normalizeUnicode(incoming.Email)
+		}
+		if present["gender"] {
+			profile.Gender = incoming.Gender
+		}
+		if present["gender_acc"] {
+			profile.GenderAcc = incoming.GenderAcc
+		}
+		if present["is_bot"] {
+			profile.IsBot = incoming.IsBot
+		}
+		if present["country"] {
+			profile.CountryCode = nil
+			if incoming.Country != nil {
+				profile.CountryCode = &incoming.Country.Code
+			}
+		}
+		if !profileFetched {
+			_, err := exec(
+				db,
+				"",
+				"insert into profiles(uuid, name, email, gender, gender_acc, is_bot, country_code) values(?,?,?,?,?,?,?)",
+				profile.UUID,
+				profile.Name,
+				profile.Email,
+				profile.Gender,
+				profile.GenderAcc,
+				profile.IsBot,
+				profile.CountryCode,
+			)
+			fatalOnError(err)
+			sts.profilesAdded++
+		} else if profileFieldsDiffer(&profile, &existing) {
+			if dbg {
+				fmt.Printf("Patching profile: %+v -> %+v\n", existing, profile)
+			}
+			_, err := exec(
+				db,
+				"",
+				"update profiles set name = ?, email = ?, gender = ?, gender_acc = ?, is_bot = ?, country_code = ? where uuid = ?",
+				profile.Name,
+				profile.Email,
+				profile.Gender,
+				profile.GenderAcc,
+				profile.IsBot,
+				profile.CountryCode,
+				profile.UUID,
 			)
 			fatalOnError(err)
-			sts.enrollmentsAdded++
+			sts.profilesPatched++
+		} else {
+			sts.profilesSame++
 		}
+	} else {
+		fmt.Printf("Patch: unique identity %s not found, skipping\n", uidentity.UUID)
+		sts.uidentitiesMissing++
 	}
 	if mtx != nil {
 		mtx.Lock()
 	}
-	stats.uidentitiesAdded += sts.uidentitiesAdded
 	stats.uidentitiesFound += sts.uidentitiesFound
-	stats.profilesAdded += sts.profilesAdded
+	stats.uidentitiesMissing += sts.uidentitiesMissing
 	stats.profilesFound += sts.profilesFound
-	stats.profilesDeleted += sts.profilesDeleted
+	stats.profilesAdded += sts.profilesAdded
+	stats.profilesPatched += sts.profilesPatched
 	stats.profilesSame += sts.profilesSame
-	stats.identitiesAdded += sts.identitiesAdded
-	stats.identitiesFound += sts.identitiesFound
-	stats.identitiesSame += sts.identitiesSame
-	stats.identitiesDeleted += sts.identitiesDeleted
-	stats.enrollmentsAdded += sts.enrollmentsAdded
-	stats.enrollmentsFound += sts.enrollmentsFound
-	stats.enrollmentsSame += sts.enrollmentsSame
-	stats.enrollmentsDeleted += sts.enrollmentsDeleted
-	stats.enrollmentsSkipped += sts.enrollmentsSkipped
+	stats.valuesTruncated += sts.valuesTruncated
 	if mtx != nil {
 		mtx.Unlock()
 	}
@@ -819,6 +3346,97 @@ func importJSONfiles(db *sql.DB, fileNames []string) error {
 	if projectSlug != "" {
 		gProjectSlug = &projectSlug
 	}
+	for env, pDate := range map[string]**time.Time{"ENROLLMENTS_FROM": &gEnrollmentsFrom, "ENROLLMENTS_TO": &gEnrollmentsTo} {
+		if os.Getenv(env) == "" {
+			continue
+		}
+		dt, err := time.Parse("2006-01-02", os.Getenv(env))
+		fatalOnError(err)
+		*pDate = &dt
+	}
+	if gEnrollmentsFrom != nil && gEnrollmentsTo != nil && !gEnrollmentsFrom.Before(*gEnrollmentsTo) {
+		fatalf("ENROLLMENTS_FROM must be before ENROLLMENTS_TO")
+	}
+	if os.Getenv("SYNC_FOUNDATION") != "" {
+		if gProjectSlug == nil || !strings.Contains(projectSlug, "/") {
+			fatalf("SYNC_FOUNDATION requires PROJECT_SLUG in 'foundation/project' format, got '%s'", projectSlug)
+		}
+		foundationSlug := strings.Split(projectSlug, "/")[0]
+		gFoundationSlug = &foundationSlug
+	}
+	gIdentityConflictPolicy = os.Getenv("IDENTITY_CONFLICT")
+	if gIdentityConflictPolicy == "" {
+		gIdentityConflictPolicy = "move"
+	}
+	if gIdentityConflictPolicy != "move" && gIdentityConflictPolicy != "skip" && gIdentityConflictPolicy != "merge" {
+		fatalf("IDENTITY_CONFLICT must be one of: move, skip, merge, got '%s'", gIdentityConflictPolicy)
+	}
+	if os.Getenv("PROFILE_MERGE") != "" {
+		policies := map[string]struct{}{"prefer-incoming": {}, "prefer-existing": {}, "prefer-non-null": {}, "newest-wins": {}}
+		fields := []string{"name", "email", "gender", "gender_acc", "is_bot", "country_code"}
+		gProfileMergePolicies = make(map[string]string)
+		for _, field := range fields {
+			gProfileMergePolicies[field] = "prefer-incoming"
+		}
+		for _, item := range strings.Split(os.Getenv("PROFILE_MERGE"), ",") {
+			ary := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			policy := strings.TrimSpace(ary[len(ary)-1])
+			_, ok := policies[policy]
+			if !ok {
+				fatalf("PROFILE_MERGE policy must be one of: prefer-incoming, prefer-existing, prefer-non-null, newest-wins, got '%s'", policy)
+			}
+			if len(ary) == 1 {
+				for _, field := range fields {
+					gProfileMergePolicies[field] = policy
+				}
+				continue
+			}
+			field := strings.TrimSpace(ary[0])
+			_, ok = gProfileMergePolicies[field]
+			if !ok {
+				fatalf("PROFILE_MERGE field must be one of: %s, got '%s'", strings.Join(fields, ", "), field)
+			}
+			gProfileMergePolicies[field] = policy
+		}
+	}
+	if os.Getenv("PRIVACY_KEY") != "" {
+		gPrivacyKey = []byte(os.Getenv("PRIVACY_KEY"))
+		fmt.Printf("Privacy mode: personal attributes are pseudonymized\n")
+	}
+	if os.Getenv("EMAIL_CANONICAL") != "" {
+		gEmailCanonical = make(map[string]bool)
+		for _, rule := range strings.Split(os.Getenv("EMAIL_CANONICAL"), ",") {
+			rule = strings.ToLower(strings.TrimSpace(rule))
+			if rule != "lower" && rule != "plus" && rule != "gmail" {
+				fatalf("EMAIL_CANONICAL rules must be any of: lower, plus, gmail, got '%s'", rule)
+			}
+			gEmailCanonical[rule] = true
+		}
+	}
+	gTransliterate = os.Getenv("TRANSLITERATE") != ""
+	gPatch = os.Getenv("PATCH") != ""
+	prune := os.Getenv("PRUNE") != ""
+	if prune {
+		// Prune preconditions are validated before anything is written
+		if gPatch {
+			fatalf("PATCH and PRUNE cannot be used together")
+		}
+		if gProjectSlug == nil {
+			fatalf("PRUNE requires PROJECT_SLUG")
+		}
+		_ = pruneMaxPct()
+	}
+	gIdentityMatching = []string{"id", "tuple"}
+	if os.Getenv("IDENTITY_MATCHING") != "" {
+		gIdentityMatching = []string{}
+		for _, key := range strings.Split(os.Getenv("IDENTITY_MATCHING"), ",") {
+			key = strings.ToLower(strings.TrimSpace(key))
+			if key != "id" && key != "email" && key != "username" && key != "tuple" {
+				fatalf("IDENTITY_MATCHING keys must be any of: id, email, username, tuple, got '%s'", key)
+			}
+			gIdentityMatching = append(gIdentityMatching, key)
+		}
+	}
 	orgsRO := os.Getenv("ORGS_RO") != ""
 	nFiles := len(fileNames)
 	if dbg {
@@ -827,6 +3445,7 @@ func importJSONfiles(db *sql.DB, fileNames []string) error {
 	uidentitiesAry := []map[string]shUIdentity{}
 	orgs := make(map[string]struct{})
 	missingOrgs := make(map[string]struct{})
+	orgsUsage := make(map[string]*orgUsage)
 	countries := make(map[string]*shCountry)
 	for i, fileName := range fileNames {
 		fmt.Printf("Importing %d/%d: %s\n", i+1, nFiles, fileName)
@@ -835,242 +3454,328 @@ func importJSONfiles(db *sql.DB, fileNames []string) error {
 		fatalOnError(err)
 		fatalOnError(json.Unmarshal(contents, &data))
 		fmt.Printf("%s: %d records\n", fileName, len(data.UIdentities))
-		for _, uidentity := range data.UIdentities {
-			for _, enrollment := range uidentity.Enrollments {
-				orgs[enrollment.Organization] = struct{}{}
+		if gPatch {
+			// Patch entries can omit uuid: it is taken from the map key, then from the profile
+			for key, uidentity := range data.UIdentities {
+				if uidentity.UUID == "" {
+					uidentity.UUID = key
+					if uidentity.UUID == "" {
+						uidentity.UUID = uidentity.Profile.UUID
+					}
+					data.UIdentities[key] = uidentity
+				}
 			}
-			if uidentity.Profile.Country != nil {
-				code := uidentity.Profile.Country.Code
-				_, ok := countries[code]
-				if !ok {
-					countries[code] = uidentity.Profile.Country
+		}
+		// Patch mode only writes profile columns, organizations and countries are not added
+		if !gPatch {
+			for _, uidentity := range data.UIdentities {
+				for _, enrollment := range uidentity.Enrollments {
+					orgs[enrollment.Organization] = struct{}{}
+					usage, ok := orgsUsage[enrollment.Organization]
+					if !ok {
+						usage = &orgUsage{uuids: make(map[string]struct{})}
+						orgsUsage[enrollment.Organization] = usage
+					}
+					usage.uuids[storedUUID(uidentity.UUID)] = struct{}{}
+					usage.enrollments++
+				}
+				if uidentity.Profile.Country != nil {
+					code := uidentity.Profile.Country.Code
+					_, ok := countries[code]
+					if !ok {
+						countries[code] = uidentity.Profile.Country
+					}
 				}
 			}
 		}
 		uidentitiesAry = append(uidentitiesAry, data.UIdentities)
 	}
+	if prune && os.Getenv("PRUNE_PREVIEW") != "" {
+		pruneMissing(db, importedUUIDs(uidentitiesAry), dbg, &importStats{})
+		fmt.Printf("Returning due to prune preview mode, nothing was imported\n")
+		return nil
+	}
+	orgsDatedMap := os.Getenv("ORGS_DATED_MAP_FILE")
+	if orgsDatedMap != "" {
+		var datedMappings allDatedMappings
+		data, err := ioutil.ReadFile(orgsDatedMap)
+		fatalOnError(err)
+		fatalOnError(yaml.Unmarshal(data, &datedMappings))
+		for _, mapping := range datedMappings.Mappings {
+			mapping.date, err = time.Parse("2006-01-02", mapping.Date)
+			fatalOnError(err)
+			gDatedMappings = append(gDatedMappings, mapping)
+		}
+		sort.SliceStable(gDatedMappings, func(i, j int) bool {
+			return gDatedMappings[i].date.Before(gDatedMappings[j].date)
+		})
+		fmt.Printf("%d date effective organization mappings\n", len(gDatedMappings))
+	}
+	orgsHierarchyFile := os.Getenv("ORGS_HIERARCHY_FILE")
+	if orgsHierarchyFile != "" {
+		gOrgsRollup = os.Getenv("ORGS_ROLLUP")
+		if gOrgsRollup == "" {
+			gOrgsRollup = "parent"
+		}
+		if gOrgsRollup != "parent" && gOrgsRollup != "subsidiary" && gOrgsRollup != "both" {
+			fatalf("ORGS_ROLLUP must be one of: parent, subsidiary, both, got '%s'", gOrgsRollup)
+		}
+		var hierarchy orgsHierarchy
+		data, err := ioutil.ReadFile(orgsHierarchyFile)
+		fatalOnError(err)
+		fatalOnError(yaml.Unmarshal(data, &hierarchy))
+		gOrgParents = make(map[string]string)
+		for subsidiary, parent := range hierarchy.Parents {
+			gOrgParents[orgKey(subsidiary)] = parent
+		}
+		if gOrgsRollup != "subsidiary" {
+			// parents of subsidiaries present in import files must be resolved or added too
+			for comp := range orgs {
+				parent, ok := topParent(comp)
+				if ok {
+					orgs[parent] = struct{}{}
+				}
+			}
+		}
+		fmt.Printf("%d organizations with parent organizations, roll-up mode: %s\n", len(gOrgParents), gOrgsRollup)
+	}
+	botsRulesFile := os.Getenv("BOTS_RULES_FILE")
+	if botsRulesFile != "" || os.Getenv("BOTS_DETECT") != "" {
+		rules := gDefaultBotRules
+		if botsRulesFile != "" {
+			var fileRules botRules
+			data, err := ioutil.ReadFile(botsRulesFile)
+			fatalOnError(err)
+			fatalOnError(yaml.Unmarshal(data, &fileRules))
+			rules = fileRules.Rules
+		}
+		gBotRules = []botRule{}
+		for _, rule := range rules {
+			if rule.Field == "" {
+				rule.Field = "any"
+			}
+			if rule.Field != "any" && rule.Field != "name" && rule.Field != "email" && rule.Field != "username" {
+				fatalf("bot rule field must be one of: any, name, email, username, got '%s'", rule.Field)
+			}
+			var err error
+			rule.rx, err = regexp.Compile(rule.Re)
+			fatalOnError(err)
+			gBotRules = append(gBotRules, rule)
+		}
+		fmt.Printf("%d bot detection rules\n", len(gBotRules))
+	}
+	gBotsSkipEnroll = os.Getenv("BOTS_SKIP_ENROLL") != ""
 	fmt.Printf("%d orgs present in import files\n", len(orgs))
-	comp2id := make(map[string]int)
-	id2comp := make(map[int]string)
-	lcomp2id := make(map[string]int)
-	id2lcomp := make(map[int]string)
-	rows, err := query(db, "select id, name from organizations")
+	registry := newOrgRegistry()
+	orgNames := []string{}
+	rows, err := query(db, "select id, name from organizations order by id")
 	fatalOnError(err)
 	orgID := 0
 	orgName := ""
 	for rows.Next() {
 		fatalOnError(rows.Scan(&orgID, &orgName))
-		lOrgName := strings.ToLower(orgName)
-		comp2id[orgName] = orgID
-		id2comp[orgID] = orgName
-		lcomp2id[lOrgName] = orgID
-		id2lcomp[orgID] = lOrgName
+		orgNames = append(orgNames, orgName)
+		registry.add(orgID, orgName)
 	}
 	fatalOnError(rows.Err())
 	fatalOnError(rows.Close())
+	// Persisted aliases are consulted before ORGS_MAP_FILE mappings
+	nAliases := loadOrgAliases(db, registry)
+	if nAliases > 0 {
+		fmt.Printf("%d organization aliases loaded\n", nAliases)
+	}
+	if len(gDatedMappings) > 0 {
+		// only targets of mappings that apply to some imported enrollment must be resolved or added
+		targets := datedMappingTargets(uidentitiesAry, registry)
+		for _, to := range targets {
+			orgs[to] = struct{}{}
+			if gOrgParents != nil && gOrgsRollup != "subsidiary" {
+				parent, ok := topParent(to)
+				if ok {
+					orgs[parent] = struct{}{}
+				}
+			}
+		}
+		fmt.Printf("%d date effective mapping targets used by enrollments\n", len(targets))
+	}
 	if dry {
 		fmt.Printf("Returing due to dry-run mode\n")
 		return nil
 	}
+	loadMatchingBlacklist(db)
+	if len(gMatchingBlacklist) > 0 {
+		fmt.Printf("%d matching blacklist entries loaded\n", len(gMatchingBlacklist))
+	}
+	// Review gate: ORGS_REVIEW only saves organizations that would be added, ORGS_APPROVED only adds approved ones
+	// Review run makes no writes, so nothing is learned
+	reviewFile := os.Getenv("ORGS_REVIEW")
+	reviewOrgs := !orgsRO && reviewFile != ""
+	// org_aliases table must exist before column limits are loaded
+	learn := os.Getenv("ORGS_LEARN") != "" && !reviewOrgs
+	if learn {
+		ensureOrgAliasesTable(db, dry)
+	}
+	loadColumnLimits(db)
+	if gEmailCanonical["plus"] || gEmailCanonical["gmail"] {
+		loadCanonicalEmails(db)
+		fmt.Printf("%d canonical emails loaded\n", len(gCanonicalEmailIDs))
+	}
 	orgsAdded := 0
+	orgsMapped := 0
 	orgsMissing := 0
 	var (
 		exists           bool
 		orgNamesMappings allMappings
 	)
 	thrN := getThreadsNum()
-	if orgsRO {
-		mut := &sync.RWMutex{}
-		orgsLoaded := false
-		processOrg := func(ch chan struct{}, comp string) {
-			defer func() {
-				if ch != nil {
-					ch <- struct{}{}
-				}
-			}()
-			mut.RLock()
-			cid, exists := comp2id[comp]
-			mut.RUnlock()
-			if !exists {
-				lComp := strings.ToLower(comp)
-				mut.RLock()
-				_, exists = lcomp2id[lComp]
-				mut.RUnlock()
-				if !exists {
-					mut.RLock()
-					if !orgsLoaded {
-						mut.RUnlock()
-						mut.Lock()
-						orgsMap := os.Getenv("ORGS_MAP_FILE")
-						if orgsMap != "" {
-							var data []byte
-							data, err = ioutil.ReadFile(orgsMap)
-							fatalOnError(err)
-							fatalOnError(yaml.Unmarshal(data, &orgNamesMappings))
-						}
-						orgsLoaded = true
-						mut.Unlock()
-					} else {
-						mut.RUnlock()
-					}
-					if dbg {
-						fmt.Printf("missing '%s'\n", comp)
-					}
-					found := false
-					for _, mapping := range orgNamesMappings.Mappings {
-						re := mapping[0]
-						re = strings.Replace(re, "\\\\", "\\", -1)
-						if dbg {
-							fmt.Printf("check if '%s' matches '%s'\n", comp, re)
-						}
-						// if comp matches re then to is our mapped company name
-						rows, err := query(db, "select ? regexp ?", comp, re)
-						fatalOnError(err)
-						var m int
-						for rows.Next() {
-							fatalOnError(rows.Scan(&m))
-						}
-						fatalOnError(rows.Err())
-						fatalOnError(rows.Close())
-						if m > 0 {
-							if dbg {
-								fmt.Printf("'%s' matches '%s'\n", comp, re)
-							}
-							to := mapping[1]
-							mut.RLock()
-							cid, exists := comp2id[to]
-							mut.RUnlock()
-							if exists {
-								if dbg {
-									fmt.Printf("added mapping '%s' -> '%s' -> %d\n", comp, to, cid)
-								}
-								mut.Lock()
-								comp2id[comp] = cid
-								id2comp[cid] = comp
-								mut.Unlock()
-								found = true
-								break
-							} else {
-								fmt.Printf("'%s' maps to '%s' which cannot be found\n", comp, to)
-							}
-						} else {
-							if dbg {
-								fmt.Printf("'%s' is not matching '%s'\n", comp, re)
-							}
-						}
-					}
-					if found {
-						return
-					}
-					if dbg {
-						fmt.Printf("missing '%s' (trying lower case '%s')\n", comp, lComp)
-					}
-					for _, mapping := range orgNamesMappings.Mappings {
-						re := mapping[0]
-						re = strings.Replace(re, "\\\\", "\\", -1)
-						if dbg {
-							fmt.Printf("check if '%s' matches '%s'\n", lComp, re)
-						}
-						// if lComp matches re then to is our mapped company name
-						rows, err := query(db, "select ? regexp ?", lComp, re)
-						fatalOnError(err)
-						var m int
-						for rows.Next() {
-							fatalOnError(rows.Scan(&m))
-						}
-						fatalOnError(rows.Err())
-						fatalOnError(rows.Close())
-						if m > 0 {
-							if dbg {
-								fmt.Printf("'%s' matches '%s'\n", lComp, re)
-							}
-							to := mapping[1]
-							mut.RLock()
-							cid, exists := lcomp2id[to]
-							mut.RUnlock()
-							if exists {
-								if dbg {
-									fmt.Printf("added mapping '%s' -> '%s' -> %d\n", lComp, to, cid)
-								}
-								mut.Lock()
-								comp2id[comp] = cid
-								id2comp[cid] = comp
-								mut.Unlock()
-								found = true
-								break
-							} else {
-								fmt.Printf("'%s' maps to '%s' which cannot be found\n", lComp, to)
-							}
-						} else {
-							if dbg {
-								fmt.Printf("'%s' is not matching '%s'\n", lComp, re)
-							}
-						}
-					}
-					if !found {
-						fmt.Printf("nothing found for '%s'\n", comp)
-						mut.Lock()
-						orgsMissing++
-						missingOrgs[comp] = struct{}{}
-						mut.Unlock()
-					}
-				} else {
-					mut.Lock()
-					comp2id[comp] = cid
-					id2comp[cid] = comp
-					mut.Unlock()
-				}
+	mut := &sync.RWMutex{}
+	orgsMap := os.Getenv("ORGS_MAP_FILE")
+	if orgsMap != "" {
+		data, err := ioutil.ReadFile(orgsMap)
+		fatalOnError(err)
+		fatalOnError(yaml.Unmarshal(data, &orgNamesMappings))
+	}
+	mapper := newOrgMapper(db, orgNamesMappings)
+	proposedOrgs := make(map[string]struct{})
+	var approvedOrgs map[string]struct{}
+	if !orgsRO && os.Getenv("ORGS_APPROVED") != "" {
+		approvedOrgs = readApprovedOrgs(os.Getenv("ORGS_APPROVED"))
+		fmt.Printf("%d organizations approved to be added\n", len(approvedOrgs))
+	}
+	// Domain inference is used for organizations that are missing: not found in ORGS_RO mode or not approved
+	if (orgsRO || approvedOrgs != nil) && os.Getenv("ORGS_DOMAINS") != "" {
+		loadDomainOrgs(db)
+		fmt.Printf("%d organizations domains loaded\n", len(gDomainOrgs))
+	}
+	// Mappings are applied in both modes, new organizations are only added when no mapping resolves (and not in ORGS_RO mode)
+	processOrg := func(ch chan struct{}, comp string) {
+		defer func() {
+			if ch != nil {
+				ch <- struct{}{}
 			}
+		}()
+		cid, exists := registry.lookup(comp)
+		if exists {
+			registry.addAlias(comp, cid)
+			return
 		}
-		if thrN > 1 {
-			ch := make(chan struct{})
-			nThreads := 0
-			for org := range orgs {
-				go processOrg(ch, org)
-				nThreads++
-				if nThreads == thrN {
-					<-ch
-					nThreads--
-				}
+		if dbg {
+			fmt.Printf("missing '%s'\n", comp)
+		}
+		cid, to, found := mapper.resolve(
+			comp,
+			registry.lookup,
+			dbg,
+		)
+		if found {
+			if dbg {
+				fmt.Printf("added mapping '%s' -> '%s' -> %d\n", comp, to, cid)
 			}
-			for nThreads > 0 {
+			registry.addAlias(comp, cid)
+			if learn {
+				addOrgAlias(db, comp, cid, cMappingSrc)
+			}
+			mut.Lock()
+			orgsMapped++
+			mut.Unlock()
+			return
+		}
+		if reviewOrgs {
+			mut.Lock()
+			proposedOrgs[comp] = struct{}{}
+			mut.Unlock()
+			return
+		}
+		approved := false
+		if approvedOrgs != nil {
+			_, approved = approvedOrgs[orgKey(comp)]
+		}
+		if orgsRO || (approvedOrgs != nil && !approved) || orgDBName(comp) == "" {
+			fmt.Printf("nothing found for '%s'\n", comp)
+			mut.Lock()
+			orgsMissing++
+			missingOrgs[comp] = struct{}{}
+			mut.Unlock()
+			return
+		}
+		var name string
+		cid, name, exists = addOrganization(db, comp)
+		registry.add(cid, name)
+		registry.addAlias(comp, cid)
+		if learn && approved {
+			addOrgAlias(db, comp, cid, cApprovedSrc)
+		}
+		mut.Lock()
+		if !exists {
+			orgsAdded++
+		}
+		mut.Unlock()
+		if dbg {
+			fmt.Printf("Org '%s' -> %d\n", comp, cid)
+		}
+	}
+	if thrN > 1 {
+		ch := make(chan struct{})
+		nThreads := 0
+		for org := range orgs {
+			go processOrg(ch, org)
+			nThreads++
+			if nThreads == thrN {
 				<-ch
 				nThreads--
 			}
-		} else {
-			for org := range orgs {
-				processOrg(nil, org)
-			}
+		}
+		for nThreads > 0 {
+			<-ch
+			nThreads--
 		}
 	} else {
-		for comp := range orgs {
-			cid, exists := comp2id[comp]
-			if !exists {
-				cid, exists = addOrganization(db, comp)
-				comp2id[comp] = cid
-				id2comp[cid] = comp
-			}
-			if !exists {
-				orgsAdded++
+		for org := range orgs {
+			processOrg(nil, org)
+		}
+	}
+	if reviewOrgs {
+		writeProposedOrgs(reviewFile, proposedOrgs, orgsUsage)
+		fmt.Printf("%d new organizations proposed, saved to %s for review, returning\n", len(proposedOrgs), reviewFile)
+		return nil
+	}
+	if len(missingOrgs) > 0 && gDomainOrgs != nil {
+		// Enrollments that will be inferred from email domains are not missing
+		missingUsage := make(map[string]*orgUsage)
+		for _, uidentities := range uidentitiesAry {
+			for _, uidentity := range uidentities {
+				if _, _, _, found := inferOrg(&uidentity, registry); found {
+					continue
+				}
+				for _, enrollment := range uidentity.Enrollments {
+					if _, ok := missingOrgs[enrollment.Organization]; !ok {
+						continue
+					}
+					usage, ok := missingUsage[enrollment.Organization]
+					if !ok {
+						usage = &orgUsage{uuids: make(map[string]struct{})}
+						missingUsage[enrollment.Organization] = usage
+					}
+					usage.uuids[storedUUID(uidentity.UUID)] = struct{}{}
+					usage.enrollments++
+				}
 			}
-			if dbg {
-				fmt.Printf("Org '%s' -> %d\n", comp, cid)
+		}
+		nInferred := 0
+		for org := range missingOrgs {
+			if _, ok := missingUsage[org]; !ok {
+				delete(missingOrgs, org)
+				nInferred++
 			}
 		}
+		orgsMissing -= nInferred
+		orgsUsage = missingUsage
+		fmt.Printf("%d missing organizations inferred from email domains for all their enrollments\n", nInferred)
 	}
-	// fmt.Printf("comp2id:%+v\nod2comp:%+v\n", comp2id, id2comp)
 	if len(missingOrgs) > 0 {
-		csvFile, err := os.Create(os.Getenv("MISSING_ORGS_CSV"))
-		fatalOnError(err)
-		defer func() { _ = csvFile.Close() }()
-		writer := csv.NewWriter(csvFile)
-		fatalOnError(writer.Write([]string{"Organization Name"}))
-		for org := range missingOrgs {
-			err = writer.Write([]string{org})
-		}
-		writer.Flush()
+		writeMissingOrgs(os.Getenv("MISSING_ORGS_CSV"), missingOrgs, orgsUsage, orgNames, thrN)
 	}
-	fmt.Printf("Number of organizations: %d, added new: %d, missing: %d\n", len(comp2id), orgsAdded, orgsMissing)
+	fmt.Printf("Number of organizations: %d, mapped: %d, added new: %d, missing: %d\n", registry.size(), orgsMapped, orgsAdded, orgsMissing)
 	countriesAdded := 0
 	for _, country := range countries {
 		exists = addCountry(db, country)
@@ -1089,7 +3794,11 @@ func importJSONfiles(db *sql.DB, fileNames []string) error {
 			ch := make(chan struct{})
 			nThreads := 0
 			for _, uidentity := range uidentities {
-				go processUIdentity(ch, mtx, db, uidentity, comp2id, id2comp, []bool{dbg, replace, compare, orgsRO}, stats)
+				if gPatch {
+					go patchUIdentity(ch, mtx, db, uidentity, dbg, stats)
+				} else {
+					go processUIdentity(ch, mtx, db, uidentity, registry, []bool{dbg, replace, compare, orgsRO || approvedOrgs != nil}, stats)
+				}
 				nThreads++
 				if nThreads == thrN {
 					<-ch
@@ -1102,14 +3811,259 @@ func importJSONfiles(db *sql.DB, fileNames []string) error {
 			}
 		} else {
 			for _, uidentity := range uidentities {
-				processUIdentity(nil, mtx, db, uidentity, comp2id, id2comp, []bool{dbg, replace, compare, orgsRO}, stats)
+				if gPatch {
+					patchUIdentity(nil, mtx, db, uidentity, dbg, stats)
+				} else {
+					processUIdentity(nil, mtx, db, uidentity, registry, []bool{dbg, replace, compare, orgsRO || approvedOrgs != nil}, stats)
+				}
 			}
 		}
 	}
+	merges := make(map[[2]string]struct{})
+	for _, merge := range gPendingMerges {
+		_, done := merges[merge]
+		if done {
+			continue
+		}
+		merges[merge] = struct{}{}
+		if mergeUIdentities(db, merge[0], merge[1]) {
+			stats.uidentitiesMerged++
+		}
+	}
+	if prune {
+		pruneMissing(db, importedUUIDs(uidentitiesAry), dbg, stats)
+	}
+	if len(gIdentityConflicts) > 0 && os.Getenv("IDENTITY_CONFLICTS_CSV") != "" {
+		writeIdentityConflicts(os.Getenv("IDENTITY_CONFLICTS_CSV"))
+	}
+	if len(gTruncations) > 0 && os.Getenv("TRUNCATIONS_CSV") != "" {
+		writeTruncations(os.Getenv("TRUNCATIONS_CSV"))
+	}
+	if len(gBotDecisions) > 0 && os.Getenv("BOTS_CSV") != "" {
+		writeBotDecisions(os.Getenv("BOTS_CSV"))
+	}
+	if len(gUIdentityMerges) > 0 && os.Getenv("MERGE_REPORT_CSV") != "" {
+		writeUIdentityMerges(os.Getenv("MERGE_REPORT_CSV"))
+	}
 	fmt.Printf("Stats:\n%+v\n", stats)
 	return nil
 }
 
+// ensureOrgAliasesTable - creates persistent organization aliases table if needed (databases created before it was added to structure.sql)
+// No DDL is issued in dry-run mode, returns whether the table exists then
+func ensureOrgAliasesTable(db *sql.DB, dry bool) bool {
+	if dry {
+		rows, err := query(db, "select 1 from information_schema.tables where table_schema = database() and table_name = 'org_aliases'")
+		fatalOnError(err)
+		exists := false
+		for rows.Next() {
+			exists = true
+		}
+		fatalOnError(rows.Err())
+		fatalOnError(rows.Close())
+		return exists
+	}
+	_, err := exec(
+		db,
+		"",
+		"create table if not exists org_aliases("+
+			"alias varchar(191) collate utf8mb4_unicode_520_ci not null, "+
+			"organization_id int(11) not null, "+
+			"src varchar(32) collate utf8mb4_unicode_520_ci default null, "+
+			"last_modified datetime(6) default null, "+
+			"primary key(alias), "+
+			"key org_aliases_organization_id_idx(organization_id), "+
+			"constraint org_aliases_organization_id_fk foreign key(organization_id) references organizations(id) on delete cascade on update cascade"+
+			") engine=InnoDB default charset=utf8mb4 collate=utf8mb4_unicode_520_ci",
+	)
+	fatalOnError(err)
+	return true
+}
+
+// addOrgAlias - stores alias of an organization in org_aliases table
+func addOrgAlias(db dbExecutor, alias string, orgID int, src string) {
+	limit, ok := gColumnLimits["org_aliases.alias"]
+	if ok && utf8.RuneCountInString(alias) > limit {
+		fmt.Printf("alias '%s' is longer than %d characters, not stored\n", alias, limit)
+		return
+	}
+	_, err := exec(
+		db,
+		"",
+		"insert into org_aliases(alias, organization_id, src, last_modified) values(?,?,?,now()) "+
+			"on duplicate key update organization_id = values(organization_id), src = values(src), last_modified = now()",
+		alias,
+		orgID,
+		src,
+	)
+	fatalOnError(err)
+}
+
+// loadOrgAliases - adds aliases from org_aliases table to the registry, returns number of aliases loaded
+func loadOrgAliases(db *sql.DB, registry *orgRegistry) (n int) {
+	rows, err := db.Query("select alias, organization_id from org_aliases")
+	if err != nil {
+		// org_aliases table doesn't exist yet
+		if strings.Contains(err.Error(), "Error 1146") {
+			return
+		}
+		fatalOnError(err)
+	}
+	for rows.Next() {
+		var (
+			alias string
+			orgID int
+		)
+		fatalOnError(rows.Scan(&alias, &orgID))
+		registry.addAlias(alias, orgID)
+		n++
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	return
+}
+
+// exportOrgAliases - exports org_aliases table in ORGS_MAP_FILE format (to stdout if no file name given)
+func exportOrgAliases(db *sql.DB, args []string) {
+	rows, err := query(db, "select a.alias, o.name from org_aliases a, organizations o where a.organization_id = o.id order by o.name, a.alias")
+	fatalOnError(err)
+	var mappings allMappings
+	for rows.Next() {
+		var alias, name string
+		fatalOnError(rows.Scan(&alias, &name))
+		// ORGS_MAP_FILE regexps use double backslashes
+		re := "^" + strings.Replace(regexp.QuoteMeta(alias), "\\", "\\\\", -1) + "$"
+		mappings.Mappings = append(mappings.Mappings, [2]string{re, name})
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	data, err := yaml.Marshal(&mappings)
+	fatalOnError(err)
+	if len(args) == 0 {
+		fmt.Printf("%s", string(data))
+		return
+	}
+	fatalOnError(ioutil.WriteFile(args[0], data, 0644))
+	fmt.Printf("%d aliases exported to %s\n", len(mappings.Mappings), args[0])
+}
+
+// findOrganization - finds organization by numeric id or by name
+func findOrganization(db dbExecutor, idOrName string) (id int, name string) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	n, e := strconv.Atoi(idOrName)
+	if e == nil {
+		rows, err = query(db, "select id, name from organizations where id = ?", n)
+	} else {
+		rows, err = query(db, "select id, name from organizations where name = ?", idOrName)
+	}
+	fatalOnError(err)
+	fetched := false
+	for rows.Next() {
+		fatalOnError(rows.Scan(&id, &name))
+		fetched = true
+	}
+	fatalOnError(rows.Err())
+	fatalOnError(rows.Close())
+	if !fetched {
+		fatalf("organization '%s' not found", idOrName)
+	}
+	return
+}
+
+// mergeOrgs - merges duplicate organizations into surviving ones: args are pairs of duplicate and surviving organizations
+// (names or ids). Affected enrollments are archived, enrollments and domains are moved to the surviving organization
+// (enrollments that would collide are deleted), merged name becomes an alias of the surviving organization.
+// With DRY=1 all changes are rolled back.
+func mergeOrgs(db *sql.DB, args []string) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		fmt.Printf("Arguments required: merge-orgs duplicate_org surviving_org [duplicate_org2 surviving_org2 [...]]\n")
+		return
+	}
+	dry := os.Getenv("DRY") != ""
+	aliases := ensureOrgAliasesTable(db, dry)
+	for i := 0; i < len(args); i += 2 {
+		tx, err := db.Begin()
+		fatalOnError(err)
+		_, err = tx.Exec("set @origin = ?", cOrigin)
+		fatalOnError(err)
+		fromID, fromName := findOrganization(tx, args[i])
+		toID, toName := findOrganization(tx, args[i+1])
+		if fromID == toID {
+			fatalOnError(tx.Rollback())
+			fatalf("cannot merge organization '%s' into itself", fromName)
+		}
+		res, err := exec(
+			tx,
+			"",
+			"insert into enrollments_archive(id, start, end, uuid, organization_id, project_slug, role) "+
+				"select id, start, end, uuid, organization_id, project_slug, role from enrollments where organization_id = ?",
+			fromID,
+		)
+		fatalOnError(err)
+		archived, err := res.RowsAffected()
+		fatalOnError(err)
+		// Manual duplicates win over derived ones (src set), their src and role are kept on the surviving enrollment
+		_, err = exec(
+			tx,
+			"",
+			"update enrollments t join enrollments e on t.uuid = e.uuid and t.start = e.start and t.end = e.end "+
+				"and t.project_slug <=> e.project_slug and e.organization_id = ? set t.src = e.src, t.role = e.role "+
+				"where t.organization_id = ? and t.src is not null and e.src is null",
+			fromID,
+			toID,
+		)
+		fatalOnError(err)
+		res, err = exec(
+			tx,
+			"",
+			"delete e from enrollments e join enrollments t on t.uuid = e.uuid and t.start = e.start and t.end = e.end "+
+				"and t.project_slug <=> e.project_slug and t.organization_id = ? where e.organization_id = ?",
+			toID,
+			fromID,
+		)
+		fatalOnError(err)
+		deleted, err := res.RowsAffected()
+		fatalOnError(err)
+		res, err = exec(tx, "", "update enrollments set organization_id = ? where organization_id = ?", toID, fromID)
+		fatalOnError(err)
+		moved, err := res.RowsAffected()
+		fatalOnError(err)
+		res, err = exec(tx, "", "update domains_organizations set organization_id = ? where organization_id = ?", toID, fromID)
+		fatalOnError(err)
+		domains, err := res.RowsAffected()
+		fatalOnError(err)
+		if aliases {
+			_, err = exec(tx, "", "update org_aliases set organization_id = ? where organization_id = ?", toID, fromID)
+			fatalOnError(err)
+		}
+		_, err = exec(tx, "", "delete from organizations where id = ?", fromID)
+		fatalOnError(err)
+		if aliases {
+			addOrgAlias(tx, fromName, toID, cMergeSrc)
+		}
+		fmt.Printf(
+			"'%s' (%d) -> '%s' (%d): archived %d enrollments, moved %d, deleted %d duplicate, moved %d domains\n",
+			fromName,
+			fromID,
+			toName,
+			toID,
+			archived,
+			moved,
+			deleted,
+			domains,
+		)
+		if dry {
+			fmt.Printf("Rolling back due to dry-run mode\n")
+			fatalOnError(tx.Rollback())
+			continue
+		}
+		fatalOnError(tx.Commit())
+	}
+}
+
 // getConnectString - get MariaDB SH (Sorting Hat) database DSN
 // Either provide full DSN via SH_DSN='shuser:shpassword@tcp(shhost:shport)/shdb?charset=utf8&parseTime=true'
 // Or use some SH_ variables, only SH_PASS is required
@@ -1165,6 +4119,9 @@ func main() {
 	// Connect to MariaDB
 	if len(os.Args) < 2 {
 		fmt.Printf("Arguments required: file.json [file2.json [...]]\n")
+		fmt.Printf("Or: merge-orgs duplicate_org surviving_org [duplicate_org2 surviving_org2 [...]]\n")
+		fmt.Printf("Or: export-org-aliases [mappings.yaml]\n")
+		fmt.Printf("Or: lint-orgs-map mappings.yaml [names.txt]\n")
 		return
 	}
 	dtStart := time.Now()
@@ -1175,7 +4132,16 @@ func main() {
 	defer func() { fatalOnError(db.Close()) }()
 	_, err = db.Exec("set @origin = ?", cOrigin)
 	fatalOnError(err)
-	err = importJSONfiles(db, os.Args[1:len(os.Args)])
+	switch os.Args[1] {
+	case "merge-orgs":
+		mergeOrgs(db, os.Args[2:])
+	case "export-org-aliases":
+		exportOrgAliases(db, os.Args[2:])
+	case "lint-orgs-map":
+		lintOrgsMap(db, os.Args[2:])
+	default:
+		err = importJSONfiles(db, os.Args[1:len(os.Args)])
+	}
 	// Trigger sync event
 	/*
 		e := ssawsync.Sync(cOrigin)
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiteralRegexp(t *testing.T) {
+	var testCases = []struct {
+		re      string
+		literal string
+		ok      bool
+	}{
+		{re: "^Foo Inc$", literal: "Foo Inc", ok: true},
+		{re: `\AFoo Inc\z`, literal: "Foo Inc", ok: true},
+		{re: `^Foo\.Inc$`, literal: "Foo.Inc", ok: true},
+		{re: `^AT\&T$`, literal: "AT&T", ok: true},
+		{re: `^\(Foo\) \[Bar\]$`, literal: "(Foo) [Bar]", ok: true},
+		{re: `^\^Foo\$$`, literal: "^Foo$", ok: true},
+		{re: `^caf\x{e9}$`, literal: "café", ok: true},
+		{re: "^Foo.Inc$", ok: false},
+		{re: "^Foo Inc", ok: false},
+		{re: "Foo Inc$", ok: false},
+		{re: "Foo Inc", ok: false},
+		{re: "^$", ok: false},
+		{re: "^Foo|Bar$", ok: false},
+		{re: "^(Foo)$", ok: false},
+		{re: "^Foo+$", ok: false},
+		{re: "^Fo[o]$", literal: "Foo", ok: true},
+		{re: "^Foo[$", ok: false},
+	}
+	for index, test := range testCases {
+		literal, ok := literalRegexp(test.re)
+		if ok != test.ok || literal != test.literal {
+			t.Errorf("test number %d: literalRegexp(%q): expected (%q, %v), got (%q, %v)", index+1, test.re, test.literal, test.ok, literal, ok)
+		}
+	}
+}
+
+func TestOrgMapperCompile(t *testing.T) {
+	var testCases = []struct {
+		re       string
+		compiled bool
+		matches  []string
+		misses   []string
+	}{
+		{re: "^Foo Inc$", compiled: true, matches: []string{"Foo Inc", "foo inc", "FOO INC"}, misses: []string{"Foo Inc.", "Foo"}},
+		{re: "[[:<:]]ibm[[:>:]]", compiled: true, matches: []string{"IBM", "IBM Research", "at ibm"}, misses: []string{"ibmx", "xibm"}},
+		{re: `^Foo\\.Inc$`, compiled: true, matches: []string{"Foo.Inc"}, misses: []string{"FooxInc"}},
+		{re: "^(Red|Blue) Hat$", compiled: true, matches: []string{"Red Hat", "blue hat"}, misses: []string{"Green Hat"}},
+		{re: `^(a)\1$`, compiled: false},
+		{re: "^Foo(?=Inc)", compiled: false},
+		{re: "^Foo(?!Inc)", compiled: false},
+		{re: "^[[:alpha:]]+$", compiled: true, matches: []string{"Foo"}, misses: []string{"Foo Inc"}},
+	}
+	for index, test := range testCases {
+		mapper := newOrgMapper(nil, allMappings{Mappings: [][2]string{{test.re, "To"}}})
+		if (mapper.rules[0].rx != nil) != test.compiled {
+			t.Errorf("test number %d: %q: expected compiled %v, got %v", index+1, test.re, test.compiled, mapper.rules[0].rx != nil)
+			continue
+		}
+		for _, comp := range test.matches {
+			if !mapper.matches(0, comp) {
+				t.Errorf("test number %d: %q should match %q", index+1, test.re, comp)
+			}
+		}
+		for _, comp := range test.misses {
+			if mapper.matches(0, comp) {
+				t.Errorf("test number %d: %q should not match %q", index+1, test.re, comp)
+			}
+		}
+	}
+}
+
+func TestOrgCandidates(t *testing.T) {
+	var testCases = []struct {
+		comp     string
+		names    []string
+		n        int
+		expected []orgCandidate
+	}{
+		{
+			comp:     "Acme Inc.",
+			names:    []string{"Acme", "ACME Ltd", "Acne", "Globex"},
+			n:        2,
+			expected: []orgCandidate{{Name: "ACME Ltd", Score: 1.0}, {Name: "Acme", Score: 1.0}},
+		},
+		{
+			comp:     "abcd",
+			names:    []string{"abcg", "abcf", "abce", "abch", "xyz"},
+			n:        2,
+			expected: []orgCandidate{{Name: "abce", Score: 0.75}, {Name: "abcf", Score: 0.75}},
+		},
+		{
+			comp:     "abcd",
+			names:    []string{"abcx", "abcd", "abxx"},
+			n:        5,
+			expected: []orgCandidate{{Name: "abcd", Score: 1.0}, {Name: "abcx", Score: 0.75}, {Name: "abxx", Score: 0.5}},
+		},
+		{
+			comp:     "abc",
+			names:    []string{"abd", "abe", "xyz"},
+			n:        1,
+			expected: []orgCandidate{{Name: "abd", Score: 0.667}},
+		},
+		{
+			comp:     "Foo",
+			names:    []string{},
+			n:        3,
+			expected: nil,
+		},
+	}
+	for index, test := range testCases {
+		normNames := make(map[string][]string)
+		for _, name := range test.names {
+			norm := normOrgName(name)
+			normNames[norm] = append(normNames[norm], name)
+		}
+		// Map iteration order differs between runs, results must not
+		for i := 0; i < 20; i++ {
+			got := orgCandidates(test.comp, normNames, test.n)
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("test number %d: orgCandidates(%q): expected %+v, got %+v", index+1, test.comp, test.expected, got)
+				break
+			}
+		}
+	}
+}
+
+func testDate(str string) time.Time {
+	dt, err := time.Parse("2006-01-02", str)
+	if err != nil {
+		panic(err)
+	}
+	return dt
+}
+
+func testEnrollment(org string, orgID int, start, end string) shEnrollment {
+	return shEnrollment{
+		Organization: org,
+		OrgID:        orgID,
+		Start:        shTime{Time: testDate(start), Set: true},
+		End:          shTime{Time: testDate(end), Set: true},
+	}
+}
+
+func testEnrollmentsStr(enrollments []shEnrollment) (strs []string) {
+	for _, e := range enrollments {
+		strs = append(strs, fmt.Sprintf("%s(%d) %s - %s", e.Organization, e.OrgID, e.Start.String(), e.End.String()))
+	}
+	return
+}
+
+func TestApplyDatedMappings(t *testing.T) {
+	registry := newOrgRegistry()
+	registry.add(1, "Acme")
+	registry.add(2, "Globex")
+	registry.add(3, "Initech")
+	registry.addAlias("Acme Corp", 1)
+	var testCases = []struct {
+		mappings    []datedMapping
+		enrollments []shEnrollment
+		expected    []string
+	}{
+		{
+			mappings:    []datedMapping{{From: "Acme", To: "Globex", Date: "2010-01-01"}},
+			enrollments: []shEnrollment{testEnrollment("Acme", 1, "2012-01-01", "2015-01-01")},
+			expected:    []string{"Globex(2) 2012-01-01 - 2015-01-01"},
+		},
+		{
+			mappings:    []datedMapping{{From: "Acme", To: "Globex", Date: "2010-01-01"}},
+			enrollments: []shEnrollment{testEnrollment("Acme", 1, "2005-01-01", "2015-01-01")},
+			expected:    []string{"Acme(1) 2005-01-01 - 2010-01-01", "Globex(2) 2010-01-01 - 2015-01-01"},
+		},
+		{
+			mappings:    []datedMapping{{From: "Acme", To: "Globex", Date: "2010-01-01"}},
+			enrollments: []shEnrollment{testEnrollment("Acme", 1, "2005-01-01", "2010-01-01")},
+			expected:    []string{"Acme(1) 2005-01-01 - 2010-01-01"},
+		},
+		{
+			mappings:    []datedMapping{{From: "Acme", To: "Globex", Date: "2010-01-01"}},
+			enrollments: []shEnrollment{testEnrollment("Acme", 1, "2010-01-01", "2015-01-01")},
+			expected:    []string{"Globex(2) 2010-01-01 - 2015-01-01"},
+		},
+		{
+			mappings:    []datedMapping{{From: "ACME CORP", To: "Globex", Date: "2010-01-01"}},
+			enrollments: []shEnrollment{testEnrollment("Acme", 1, "2012-01-01", "2015-01-01")},
+			expected:    []string{"Globex(2) 2012-01-01 - 2015-01-01"},
+		},
+		{
+			mappings:    []datedMapping{{From: "Globex", To: "Initech", Date: "2010-01-01"}},
+			enrollments: []shEnrollment{testEnrollment("Acme", 1, "2005-01-01", "2015-01-01")},
+			expected:    []string{"Acme(1) 2005-01-01 - 2015-01-01"},
+		},
+		{
+			mappings:    []datedMapping{{From: "Acme", To: "Unknown", Date: "2010-01-01"}},
+			enrollments: []shEnrollment{testEnrollment("Acme", 1, "2005-01-01", "2015-01-01")},
+			expected:    []string{"Acme(1) 2005-01-01 - 2015-01-01"},
+		},
+		{
+			mappings: []datedMapping{
+				{From: "Acme", To: "Globex", Date: "2010-01-01"},
+				{From: "Globex", To: "Initech", Date: "2015-01-01"},
+			},
+			enrollments: []shEnrollment{testEnrollment("Acme", 1, "2005-01-01", "2020-01-01")},
+			expected: []string{
+				"Acme(1) 2005-01-01 - 2010-01-01",
+				"Globex(2) 2010-01-01 - 2015-01-01",
+				"Initech(3) 2015-01-01 - 2020-01-01",
+			},
+		},
+		{
+			// Cyclic mappings stop after as many steps as there are mappings
+			mappings: []datedMapping{
+				{From: "Acme", To: "Globex", Date: "2010-01-01"},
+				{From: "Globex", To: "Acme", Date: "2010-01-01"},
+			},
+			enrollments: []shEnrollment{testEnrollment("Acme", 1, "2012-01-01", "2015-01-01")},
+			expected:    []string{"Globex(2) 2012-01-01 - 2015-01-01"},
+		},
+		{
+			mappings: []datedMapping{{From: "Acme", To: "Globex", Date: "2010-01-01"}},
+			enrollments: []shEnrollment{
+				testEnrollment("Unknown", 0, "2012-01-01", "2015-01-01"),
+				testEnrollment("Initech", 3, "2012-01-01", "2015-01-01"),
+			},
+			expected: []string{"Unknown(0) 2012-01-01 - 2015-01-01", "Initech(3) 2012-01-01 - 2015-01-01"},
+		},
+	}
+	saved := gDatedMappings
+	defer func() { gDatedMappings = saved }()
+	for index, test := range testCases {
+		gDatedMappings = nil
+		for _, mapping := range test.mappings {
+			mapping.date = testDate(mapping.Date)
+			gDatedMappings = append(gDatedMappings, mapping)
+		}
+		got := testEnrollmentsStr(applyDatedMappings(test.enrollments, registry.resolve, false))
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("test number %d: expected %v, got %v", index+1, test.expected, got)
+		}
+	}
+}
+
+func TestCanonicalEmail(t *testing.T) {
+	var testCases = []struct {
+		rules    map[string]bool
+		email    string
+		expected string
+	}{
+		{rules: nil, email: "J.Doe+lists@GMail.com", expected: "J.Doe+lists@GMail.com"},
+		{rules: map[string]bool{"lower": true}, email: " J.Doe@Example.COM ", expected: "j.doe@example.com"},
+		{rules: map[string]bool{"plus": true}, email: "john+lists@example.com", expected: "john@example.com"},
+		{rules: map[string]bool{"plus": true}, email: "john+a+b@example.com", expected: "john@example.com"},
+		{rules: map[string]bool{"plus": true}, email: "john@example+x.com", expected: "john@example+x.com"},
+		{rules: map[string]bool{"plus": true}, email: "+lists@example.com", expected: "@example.com"},
+		{rules: map[string]bool{"plus": true}, email: "john+lists", expected: "john+lists"},
+		{rules: map[string]bool{"gmail": true}, email: "j.o.hn@gmail.com", expected: "john@gmail.com"},
+		{rules: map[string]bool{"gmail": true}, email: "j.ohn@GoogleMail.com", expected: "john@gmail.com"},
+		{rules: map[string]bool{"gmail": true}, email: "j.ohn@example.com", expected: "j.ohn@example.com"},
+		{rules: map[string]bool{"gmail": true}, email: "j.ohn@mail.gmail.com", expected: "j.ohn@mail.gmail.com"},
+		{rules: map[string]bool{"gmail": true}, email: "j.ohn", expected: "j.ohn"},
+		{rules: map[string]bool{"lower": true, "plus": true, "gmail": true}, email: "J.Ohn+Tag@GoogleMail.com", expected: "john@gmail.com"},
+		{rules: map[string]bool{"lower": true, "plus": true, "gmail": true}, email: "J.Ohn+Tag", expected: "j.ohn+tag"},
+	}
+	saved := gEmailCanonical
+	defer func() { gEmailCanonical = saved }()
+	for index, test := range testCases {
+		gEmailCanonical = test.rules
+		got := canonicalEmail(test.email)
+		if got != test.expected {
+			t.Errorf("test number %d: canonicalEmail(%q) with %v: expected %q, got %q", index+1, test.email, test.rules, test.expected, got)
+		}
+	}
+}
+
+func TestPseudonymizeStr(t *testing.T) {
+	str := func(s string) *string { return &s }
+	var testCases = []struct {
+		kind   string
+		value  *string
+		other  *string
+		same   bool
+		prefix string
+		suffix string
+		length int
+	}{
+		{kind: "name", value: nil, length: -1},
+		{kind: "email", value: str(""), length: 0},
+		{kind: "name", value: str("John Doe"), prefix: "User ", length: 17},
+		{kind: "username", value: str("jdoe"), prefix: "user-", length: 17},
+		{kind: "email", value: str("john@example.com"), suffix: "@example.com", length: 28},
+		{kind: "email", value: str("john"), length: 16},
+		{kind: "email", value: str("john@a@example.com"), suffix: "@example.com", length: 28},
+		{kind: "email", value: str("john+lists@example.com"), other: str("john@example.com"), same: true},
+		{kind: "email", value: str("J.Ohn@GoogleMail.com"), other: str("john@gmail.com"), same: true, suffix: "@GoogleMail.com"},
+		{kind: "email", value: str("john+lists"), other: str("john"), same: false},
+		{kind: "email", value: str("john@example.com"), other: str("john@example.org"), same: true},
+		{kind: "email", value: str("john@example.com"), other: str("jane@example.com"), same: false},
+		{kind: "name", value: str("John Doe"), other: str("John Doe"), same: true},
+		{kind: "name", value: str("John Doe"), other: str("Jane Doe"), same: false},
+	}
+	savedKey, savedRules := gPrivacyKey, gEmailCanonical
+	defer func() { gPrivacyKey, gEmailCanonical = savedKey, savedRules }()
+	gPrivacyKey = []byte("test key")
+	gEmailCanonical = map[string]bool{"lower": true, "plus": true, "gmail": true}
+	for index, test := range testCases {
+		got := pseudonymizeStr(test.kind, test.value)
+		if test.value == nil || *test.value == "" {
+			if got != test.value {
+				t.Errorf("test number %d: empty value should be kept, got %v", index+1, got)
+			}
+			continue
+		}
+		if *got == *test.value {
+			t.Errorf("test number %d: %q was not pseudonymized", index+1, *test.value)
+		}
+		if !strings.HasPrefix(*got, test.prefix) || !strings.HasSuffix(*got, test.suffix) {
+			t.Errorf("test number %d: %q -> %q: expected prefix %q and suffix %q", index+1, *test.value, *got, test.prefix, test.suffix)
+		}
+		if test.length > 0 && len(*got) != test.length {
+			t.Errorf("test number %d: %q -> %q: expected length %d, got %d", index+1, *test.value, *got, test.length, len(*got))
+		}
+		if test.other != nil {
+			// Emails are compared by local part pseudonym
+			other := pseudonymizeStr(test.kind, test.other)
+			local := func(s string) string { return strings.Split(s, "@")[0] }
+			if (local(*got) == local(*other)) != test.same {
+				t.Errorf("test number %d: %q -> %q, %q -> %q: expected same %v", index+1, *test.value, *got, *test.other, *other, test.same)
+			}
+		}
+	}
+}
+
+func TestProfileUnmarshalJSON(t *testing.T) {
+	var testCases = []struct {
+		data     string
+		present  []string
+		name     *string
+		isBot    *bool
+		hasError bool
+	}{
+		{data: `{}`, present: []string{}},
+		{data: `{"name": null}`, present: []string{"name"}},
+		{data: `{"name": "John"}`, present: []string{"name"}, name: strPtrTest("John")},
+		{data: `{"uuid": "u1", "is_bot": false, "gender_acc": null}`, present: []string{"gender_acc", "is_bot", "uuid"}, isBot: boolPtrTest(false)},
+		{data: `{"country": null, "email": null, "gender": null}`, present: []string{"country", "email", "gender"}},
+		{data: `{"unknown": 1, "name": "John"}`, present: []string{"name", "unknown"}, name: strPtrTest("John")},
+		{data: `{"name": 1}`, hasError: true},
+		{data: `[]`, hasError: true},
+	}
+	for index, test := range testCases {
+		var profile shProfile
+		err := json.Unmarshal([]byte(test.data), &profile)
+		if (err != nil) != test.hasError {
+			t.Errorf("test number %d: %s: expected error %v, got %v", index+1, test.data, test.hasError, err)
+			continue
+		}
+		if test.hasError {
+			continue
+		}
+		present := []string{}
+		for key, ok := range profile.present {
+			if ok {
+				present = append(present, key)
+			}
+		}
+		sort.Strings(present)
+		if !reflect.DeepEqual(present, test.present) {
+			t.Errorf("test number %d: %s: expected present %v, got %v", index+1, test.data, test.present, present)
+		}
+		if !reflect.DeepEqual(profile.Name, test.name) || !reflect.DeepEqual(profile.IsBot, test.isBot) {
+			t.Errorf("test number %d: %s: expected name %v, is_bot %v, got %v, %v", index+1, test.data, test.name, test.isBot, profile.Name, profile.IsBot)
+		}
+	}
+	// Profile nested in uidentity is decoded the same way
+	var data shData
+	err := json.Unmarshal([]byte(`{"uidentities": {"u1": {"profile": {"email": null}}}}`), &data)
+	if err != nil {
+		t.Fatalf("shData: %v", err)
+	}
+	profile := data.UIdentities["u1"].Profile
+	if !profile.present["email"] || profile.present["name"] || profile.Email != nil {
+		t.Errorf("shData: expected only explicit null email present, got %+v", profile.present)
+	}
+}
+
+func strPtrTest(s string) *string {
+	return &s
+}
+
+func boolPtrTest(b bool) *bool {
+	return &b
+}
+
+func TestEnrollmentsWindow(t *testing.T) {
+	from, to := testDate("2010-01-01"), testDate("2020-01-01")
+	var testCases = []struct {
+		from    *time.Time
+		to      *time.Time
+		e       shEnrollment
+		clipped []string
+		outside []string
+	}{
+		{from: &from, to: &to, e: testEnrollment("Acme", 1, "2012-01-01", "2015-01-01"), clipped: []string{"Acme(1) 2012-01-01 - 2015-01-01"}},
+		{from: &from, to: &to, e: testEnrollment("Acme", 1, "2010-01-01", "2020-01-01"), clipped: []string{"Acme(1) 2010-01-01 - 2020-01-01"}},
+		{
+			from:    &from,
+			to:      &to,
+			e:       testEnrollment("Acme", 1, "1900-01-01", "2100-01-01"),
+			clipped: []string{"Acme(1) 2010-01-01 - 2020-01-01"},
+			outside: []string{"Acme(1) 1900-01-01 - 2010-01-01", "Acme(1) 2020-01-01 - 2100-01-01"},
+		},
+		{from: &from, to: &to, e: testEnrollment("Acme", 1, "2005-01-01", "2010-01-01"), outside: []string{"Acme(1) 2005-01-01 - 2010-01-01"}},
+		{from: &from, to: &to, e: testEnrollment("Acme", 1, "2020-01-01", "2025-01-01"), outside: []string{"Acme(1) 2020-01-01 - 2025-01-01"}},
+		{
+			from:    &from,
+			to:      &to,
+			e:       testEnrollment("Acme", 1, "2005-01-01", "2010-01-02"),
+			clipped: []string{"Acme(1) 2010-01-01 - 2010-01-02"},
+			outside: []string{"Acme(1) 2005-01-01 - 2010-01-01"},
+		},
+		{
+			from:    &from,
+			to:      &to,
+			e:       testEnrollment("Acme", 1, "2019-12-31", "2025-01-01"),
+			clipped: []string{"Acme(1) 2019-12-31 - 2020-01-01"},
+			outside: []string{"Acme(1) 2020-01-01 - 2025-01-01"},
+		},
+		{
+			from:    &from,
+			e:       testEnrollment("Acme", 1, "1900-01-01", "2100-01-01"),
+			clipped: []string{"Acme(1) 2010-01-01 - 2100-01-01"},
+			outside: []string{"Acme(1) 1900-01-01 - 2010-01-01"},
+		},
+		{
+			to:      &to,
+			e:       testEnrollment("Acme", 1, "1900-01-01", "2100-01-01"),
+			clipped: []string{"Acme(1) 1900-01-01 - 2020-01-01"},
+			outside: []string{"Acme(1) 2020-01-01 - 2100-01-01"},
+		},
+		{e: testEnrollment("Acme", 1, "1900-01-01", "2100-01-01"), clipped: []string{"Acme(1) 1900-01-01 - 2100-01-01"}},
+	}
+	savedFrom, savedTo := gEnrollmentsFrom, gEnrollmentsTo
+	defer func() { gEnrollmentsFrom, gEnrollmentsTo = savedFrom, savedTo }()
+	for index, test := range testCases {
+		gEnrollmentsFrom, gEnrollmentsTo = test.from, test.to
+		var clipped []shEnrollment
+		e, ok := clipToWindow(test.e)
+		if ok {
+			clipped = append(clipped, e)
+		}
+		got := testEnrollmentsStr(clipped)
+		if !reflect.DeepEqual(got, test.clipped) {
+			t.Errorf("test number %d: clipToWindow: expected %v, got %v", index+1, test.clipped, got)
+		}
+		got = testEnrollmentsStr(outsideWindow(test.e))
+		if !reflect.DeepEqual(got, test.outside) {
+			t.Errorf("test number %d: outsideWindow: expected %v, got %v", index+1, test.outside, got)
+		}
+	}
+}
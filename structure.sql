@@ -305,6 +305,24 @@ CREATE TABLE `matching_blacklist` (
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `org_aliases`
+--
+
+DROP TABLE IF EXISTS `org_aliases`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `org_aliases` (
+  `alias` varchar(191) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  `organization_id` int(11) NOT NULL,
+  `src` varchar(32) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  `last_modified` datetime(6) DEFAULT NULL,
+  PRIMARY KEY (`alias`),
+  KEY `org_aliases_organization_id_idx` (`organization_id`),
+  CONSTRAINT `org_aliases_organization_id_fk` FOREIGN KEY (`organization_id`) REFERENCES `organizations` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `organizations`
 --